@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// AggregateReport is the consolidated ring rollup printed by the aggregate
+// mode.
+type AggregateReport struct {
+	Supervisor    *SysInfo            `json:"supervisor,omitempty"`
+	Status        string              `json:"status"`
+	ServiceGroups []GroupReport       `json:"service_groups"`
+	Versions      map[string][]string `json:"supervisor_versions,omitempty"`
+	VersionDrift  string              `json:"version_drift,omitempty"`
+	Partition     string              `json:"partition,omitempty"`
+	Labels        map[string]string   `json:"labels,omitempty"`
+}
+
+type GroupReport struct {
+	ServiceGroup string         `json:"service_group"`
+	Status       string         `json:"status"`
+	OK           int            `json:"ok"`
+	Warning      int            `json:"warning"`
+	Critical     int            `json:"critical"`
+	Unknown      int            `json:"unknown"`
+	NotAlive     int            `json:"not_alive"`
+	Message      string         `json:"message,omitempty"`
+	Members      []MemberReport `json:"members"`
+}
+
+type MemberReport struct {
+	MemberID string `json:"member_id"`
+	Hostname string `json:"hostname"`
+	Alive    bool   `json:"alive"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func executeAggregate(client *http.Client) (int, error) {
+	census, err := getCensus(client)
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not retrieve census: %v", err)
+	}
+
+	// compare the views of the whole ring before narrowing it down
+	var partition string
+	if plugin.PartitionCheck > 0 {
+		partition = checkPartition(census, client)
+	}
+
+	census, err = scopeCensus(census, plugin.MemberID)
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+
+	report := aggregateCensus(census, client)
+	if partition != "" {
+		report.Partition = partition
+		report.Status = statusName(sensu.CheckStateCritical)
+	}
+
+	// the rollup is still useful without it, leave it out on failure
+	report.Supervisor, _ = getSupervisorSys(getSupervisorUrl(), client)
+
+	status := sensu.CheckStateOK
+	switch report.Status {
+	case "CRITICAL", "UNKNOWN":
+		status = sensu.CheckStateCritical
+	case "WARNING":
+		status = sensu.CheckStateWarning
+	}
+
+	if plugin.Quiet {
+		printQuiet(status, fmt.Sprintf("Aggregate %s: %d service groups", report.Status, len(report.ServiceGroups)))
+		return status, nil
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("failed to encode aggregate report: %v", err)
+	}
+
+	return status, nil
+}
+
+func aggregateCensus(census *CensusResponse, client *http.Client) AggregateReport {
+	report := AggregateReport{Labels: extraLabels}
+	overall := sensu.CheckStateOK
+
+	for _, name := range sortedGroupNames(census) {
+		group := census.CensusGroups[name]
+		gr := GroupReport{ServiceGroup: name}
+		var statuses []int
+
+		for _, id := range sortedMemberIDs(group) {
+			member := group.Population[id]
+			mr := MemberReport{
+				MemberID: member.MemberID,
+				Hostname: member.Sys.Hostname,
+				Alive:    member.Alive,
+			}
+
+			// only alive members have a gateway worth asking
+			if !member.Alive {
+				gr.NotAlive++
+				gr.Members = append(gr.Members, mr)
+				continue
+			}
+
+			h := checkService(member.gatewayURL(), name, client)
+			mr.Status = statusName(h.Status)
+			if h.Error != nil {
+				mr.Error = h.Error.Error()
+			}
+
+			switch h.Status {
+			case sensu.CheckStateOK:
+				gr.OK++
+			case sensu.CheckStateWarning:
+				gr.Warning++
+			case sensu.CheckStateCritical:
+				gr.Critical++
+			default:
+				gr.Unknown++
+			}
+
+			statuses = append(statuses, h.Status)
+			gr.Members = append(gr.Members, mr)
+		}
+
+		status := rollupStrategy.rollup(statuses)
+
+		// nothing left to roll up, the service has fallen off the ring
+		// unless it is expected to be empty
+		if len(statuses) == 0 {
+			if n, ok := expectedMembers[name]; ok && n == 0 {
+				status = sensu.CheckStateOK
+				gr.Message = "no alive members, as expected"
+			} else {
+				status = sensu.CheckStateCritical
+				gr.Message = "no alive members in the ring"
+			}
+		}
+
+		gr.Status = statusName(status)
+		overall = worseStatus(overall, status)
+		report.ServiceGroups = append(report.ServiceGroups, gr)
+	}
+
+	// a scoped census only holds the groups of one member
+	if plugin.MemberID == "" {
+		for _, name := range missingGroups(census) {
+			report.ServiceGroups = append(report.ServiceGroups, GroupReport{
+				ServiceGroup: name,
+				Status:       statusName(sensu.CheckStateCritical),
+				Message:      "not in the census, no member of the ring runs it",
+			})
+			overall = sensu.CheckStateCritical
+		}
+		sort.Slice(report.ServiceGroups, func(i, j int) bool {
+			return report.ServiceGroups[i].ServiceGroup < report.ServiceGroups[j].ServiceGroup
+		})
+	}
+
+	if plugin.VersionTolerance >= 0 {
+		report.Versions = memberVersions(census, client)
+		if drift := versionDrift(report.Versions, plugin.VersionTolerance); drift != "" {
+			report.VersionDrift = drift
+			overall = worseStatus(overall, sensu.CheckStateWarning)
+		}
+	}
+
+	report.Status = statusName(overall)
+
+	return report
+}
+
+// memberVersions asks every alive member for its supervisor version and
+// returns the member hostnames keyed by version. The census does not carry
+// the version so it comes from the sys block of each member's /services.
+func memberVersions(census *CensusResponse, client *http.Client) map[string][]string {
+	members := map[string]CensusMember{}
+	for _, group := range census.CensusGroups {
+		for _, m := range group.Population {
+			if m.Alive {
+				members[m.MemberID] = m
+			}
+		}
+	}
+
+	result := map[string][]string{}
+	for _, m := range members {
+		sys, err := getSupervisorSys(m.gatewayURL(), client)
+		if err != nil || sys == nil || sys.Version == "" {
+			continue
+		}
+		name := m.Sys.Hostname
+		if name == "" {
+			name = m.MemberID
+		}
+		result[sys.Version] = append(result[sys.Version], name)
+	}
+
+	for v := range result {
+		sort.Strings(result[v])
+	}
+
+	return result
+}
+
+// versionDrift describes how the given supervisor versions diverge, or
+// returns an empty string when they are within tolerance patch releases of
+// each other on the same major.minor line.
+func versionDrift(versions map[string][]string, tolerance int) string {
+	lines := map[string]bool{}
+	minPatch, maxPatch := -1, -1
+	var minVersion, maxVersion string
+
+	for v := range versions {
+		line, patch, err := splitVersion(v)
+		if err != nil {
+			return fmt.Sprintf("unable to compare supervisor version %q", v)
+		}
+		lines[line] = true
+
+		if minPatch == -1 || patch < minPatch {
+			minPatch, minVersion = patch, v
+		}
+		if patch > maxPatch {
+			maxPatch, maxVersion = patch, v
+		}
+	}
+
+	if len(lines) > 1 {
+		names := make([]string, 0, len(versions))
+		for v := range versions {
+			names = append(names, v)
+		}
+		sort.Strings(names)
+		return fmt.Sprintf("supervisors run different release lines: %s", strings.Join(names, ", "))
+	}
+
+	if maxPatch-minPatch > tolerance {
+		return fmt.Sprintf("supervisor versions %s and %s are more than %d releases apart", minVersion, maxVersion, tolerance)
+	}
+
+	return ""
+}
+
+// splitVersion splits a supervisor version such as "1.6.56/20220701171503"
+// into its major.minor line and patch number.
+func splitVersion(version string) (string, int, error) {
+	version = strings.SplitN(version, "/", 2)[0]
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return "", 0, fmt.Errorf("unexpected version format %q", version)
+	}
+
+	patch, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return parts[0] + "." + parts[1], patch, nil
+}
+
+// worseStatus returns the more severe of two check states, an unknown state
+// counts as more severe than critical.
+func worseStatus(a int, b int) int {
+	if a == sensu.CheckStateUnknown || b == sensu.CheckStateUnknown {
+		return sensu.CheckStateUnknown
+	}
+	if b > a {
+		return b
+	}
+	return a
+}
+
+func sortedGroupNames(census *CensusResponse) []string {
+	names := make([]string, 0, len(census.CensusGroups))
+	for name := range census.CensusGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedMemberIDs(group CensusGroup) []string {
+	ids := make([]string, 0, len(group.Population))
+	for id := range group.Population {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
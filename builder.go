@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// builderLatency holds the parsed --builder-latency duration.
+var builderLatency time.Duration
+
+// probeBuilder sends a HEAD request to --builder-url, a host that cannot reach
+// its depot silently stops receiving package updates.
+func probeBuilder() []Finding {
+	client := &http.Client{Timeout: time.Duration(plugin.Timeout) * time.Second}
+
+	req, err := http.NewRequest("HEAD", plugin.BuilderURL, nil)
+	if err != nil {
+		return []Finding{{ServiceGroup: "builder", Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+	if plugin.BuilderToken != "" {
+		req.Header.Set("Authorization", "Bearer "+plugin.BuilderToken)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		return []Finding{{
+			ServiceGroup: "builder",
+			Status:       sensu.CheckStateCritical,
+			Message:      fmt.Sprintf("%s unreachable: %v", plugin.BuilderURL, err),
+		}}
+	}
+	resp.Body.Close()
+
+	addMetric("habitat_builder_latency_seconds", elapsed.Seconds(), map[string]string{"url": plugin.BuilderURL})
+
+	// an on-prem depot rejecting the token blocks updates as surely as an
+	// outage
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode >= 500 {
+		return []Finding{{
+			ServiceGroup: "builder",
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("HEAD %s: %s", plugin.BuilderURL, resp.Status),
+		}}
+	}
+
+	if builderLatency > 0 && elapsed > builderLatency {
+		return []Finding{{
+			ServiceGroup: "builder",
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("HEAD %s took %s, budget %s", plugin.BuilderURL, elapsed.Round(time.Millisecond), builderLatency),
+		}}
+	}
+
+	return nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+var (
+	// expectedMembers holds the parsed --expected-members values.
+	expectedMembers map[string]int
+
+	// groupChecks holds the parsed --group-check percentages.
+	groupChecks map[string]int
+)
+
+// Finding is a ring level problem reported alongside the per service health.
+type Finding struct {
+	ServiceGroup string
+	Status       int
+	Message      string
+}
+
+// CensusResponse is the subset of the supervisor /census payload used by the
+// ring wide checks.
+type CensusResponse struct {
+	CensusGroups map[string]CensusGroup `json:"census_groups"`
+}
+
+// decodeStream walks a /census payload, which runs to tens of megabytes in
+// big rings, holding no more than a single member in memory at a time.
+func (r *CensusResponse) decodeStream(dec *json.Decoder) error {
+	if _, err := expectDelim(dec, '{', "", reflect.TypeOf(r)); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key != "census_groups" {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ok, err := expectDelim(dec, '{', "census_groups", reflect.TypeOf(r.CensusGroups))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		r.CensusGroups = map[string]CensusGroup{}
+		for dec.More() {
+			name, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			var group CensusGroup
+			if err := group.decodeStream(dec); err != nil {
+				return err
+			}
+			r.CensusGroups[fmt.Sprint(name)] = group
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+func (g *CensusGroup) decodeStream(dec *json.Decoder) error {
+	if _, err := expectDelim(dec, '{', "census_groups", reflect.TypeOf(g)); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "service_group":
+			err = dec.Decode(&g.ServiceGroup)
+		case "election_status":
+			err = dec.Decode(&g.ElectionStatus)
+		case "update_election_status":
+			err = dec.Decode(&g.UpdateElectionStatus)
+		case "population":
+			err = g.decodePopulation(dec)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+func (g *CensusGroup) decodePopulation(dec *json.Decoder) error {
+	ok, err := expectDelim(dec, '{', "population", reflect.TypeOf(g.Population))
+	if err != nil || !ok {
+		return err
+	}
+
+	g.Population = map[string]CensusMember{}
+	for dec.More() {
+		id, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var member CensusMember
+		if err := dec.Decode(&member); err != nil {
+			return err
+		}
+		g.Population[fmt.Sprint(id)] = member
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+func (r *CensusResponse) checkShape() error {
+	if r.CensusGroups == nil {
+		return fmt.Errorf("has no census_groups")
+	}
+	return nil
+}
+
+type CensusGroup struct {
+	ServiceGroup         string                  `json:"service_group"`
+	ElectionStatus       string                  `json:"election_status"`
+	UpdateElectionStatus string                  `json:"update_election_status"`
+	Population           map[string]CensusMember `json:"population"`
+}
+
+type CensusMember struct {
+	MemberID     string    `json:"member_id"`
+	Service      string    `json:"service"`
+	Group        string    `json:"group"`
+	Alive        bool      `json:"alive"`
+	Suspect      bool      `json:"suspect"`
+	Confirmed    bool      `json:"confirmed"`
+	Departed     bool      `json:"departed"`
+	UpdateLeader bool      `json:"update_leader"`
+	Sys          MemberSys `json:"sys"`
+}
+
+type MemberSys struct {
+	IP              string `json:"ip"`
+	Hostname        string `json:"hostname"`
+	HTTPGatewayIP   string `json:"http_gateway_ip"`
+	HTTPGatewayPort int    `json:"http_gateway_port"`
+}
+
+func getCensus(client *http.Client) (*CensusResponse, error) {
+	return getCensusFrom(getSupervisorUrl(), client)
+}
+
+func getCensusFrom(baseURL string, client *http.Client) (*CensusResponse, error) {
+	resp, err := gatewayGet(client, baseURL+"/census")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var census CensusResponse
+	if err := decodeJSON(resp, &census, "census"); err != nil {
+		return nil, err
+	}
+
+	return &census, nil
+}
+
+// gatewayURL builds the HTTP gateway URL of a census member, reusing the
+// scheme of the configured supervisor URL.
+func (m CensusMember) gatewayURL() string {
+	scheme := "http"
+	if u, err := url.Parse(plugin.SupervisorURL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+
+	// gateways listening on all interfaces advertise the unspecified address,
+	// the member's own IP is the one to dial
+	host := m.Sys.HTTPGatewayIP
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = m.Sys.IP
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(m.Sys.HTTPGatewayPort))
+}
+
+// checkCensus runs the census based checks that have been enabled, the census
+// is only fetched when at least one of them is or metrics are printed.
+func checkCensus(client *http.Client) ([]Finding, error) {
+	if len(expectedMembers) == 0 && len(groupChecks) == 0 && plugin.SuspectWarn == 0 && plugin.SuspectCrit == 0 && !plugin.UpdateLeader && electionGrace == 0 && !plugin.RingMetrics {
+		return nil, nil
+	}
+
+	census, err := getCensus(client)
+	if err != nil {
+		return nil, err
+	}
+
+	if plugin.RingMetrics {
+		addRingMetrics(census)
+	}
+
+	// member counts and update leaders are properties of the whole group,
+	// the member checks can be narrowed to --member-id
+	scoped, err := scopeCensus(census, plugin.MemberID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Finding
+	result = append(result, checkExpectedMembers(census)...)
+	result = append(result, checkSuspectMembers(scoped)...)
+	result = append(result, checkGroups(scoped, client)...)
+
+	if electionGrace > 0 {
+		state, err := loadState(plugin.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, trackElections(state, census, time.Now())...)
+		if err := state.save(plugin.StateFile); err != nil {
+			return nil, fmt.Errorf("failed to save state file %s: %v", plugin.StateFile, err)
+		}
+	}
+
+	if plugin.UpdateLeader {
+		services, err := getServiceDetails(getSupervisorUrl(), client)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, checkUpdateLeaders(census, services)...)
+	}
+
+	return result, nil
+}
+
+func checkExpectedMembers(census *CensusResponse) []Finding {
+	var result []Finding
+
+	groups := make([]string, 0, len(expectedMembers))
+	for group := range expectedMembers {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		expected := expectedMembers[group]
+		alive := census.CensusGroups[group].aliveCount()
+
+		// fewer members than planned is lost capacity, more usually means an
+		// orphaned supervisor still gossiping into the group
+		if alive == 0 && expected > 0 {
+			result = append(result, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateCritical,
+				Message:      fmt.Sprintf("no alive members anywhere in the ring, expected %d", expected),
+			})
+		} else if alive < expected {
+			result = append(result, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateCritical,
+				Message:      fmt.Sprintf("%d alive members, expected %d", alive, expected),
+			})
+		} else if alive > expected {
+			result = append(result, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("%d alive members, expected %d", alive, expected),
+			})
+		}
+	}
+
+	return result
+}
+
+// addRingMetrics counts the members of the ring by state, each member once
+// however many groups it is part of.
+func addRingMetrics(census *CensusResponse) {
+	states := map[string]string{}
+	for _, group := range census.CensusGroups {
+		for id, m := range group.Population {
+			switch {
+			case m.Departed:
+				states[id] = "departed"
+			case m.Confirmed:
+				states[id] = "confirmed"
+			case m.Suspect:
+				states[id] = "suspect"
+			case m.Alive:
+				states[id] = "alive"
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	for _, state := range states {
+		counts[state]++
+	}
+
+	for _, state := range []string{"alive", "suspect", "confirmed", "departed"} {
+		addMetric("habitat_ring_members", float64(counts[state]), map[string]string{"state": state})
+	}
+}
+
+// missingGroups returns the service groups named by --service,
+// --expected-members or --group-check that have no entry in the census.
+func missingGroups(census *CensusResponse) []string {
+	expected := map[string]bool{}
+	for _, group := range plugin.Services {
+		expected[group] = true
+	}
+	// a group expected to have no members may well be missing
+	for group, n := range expectedMembers {
+		if n > 0 {
+			expected[group] = true
+		}
+	}
+	for group := range groupChecks {
+		expected[group] = true
+	}
+
+	var result []string
+	for group := range expected {
+		if _, ok := census.CensusGroups[group]; !ok {
+			result = append(result, group)
+		}
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func (g CensusGroup) aliveCount() int {
+	count := 0
+	for _, m := range g.Population {
+		if m.Alive {
+			count++
+		}
+	}
+	return count
+}
+
+// checkSuspectMembers counts members the ring suspects of having failed.
+// Suspects are reported on their own rather than with departed or confirmed
+// dead members since they are the early sign of network trouble.
+func checkSuspectMembers(census *CensusResponse) []Finding {
+	if plugin.SuspectWarn == 0 && plugin.SuspectCrit == 0 {
+		return nil
+	}
+
+	// a member shows up once per service group it runs, count it once
+	suspects := map[string]string{}
+	for _, group := range census.CensusGroups {
+		for _, m := range group.Population {
+			if m.Suspect {
+				suspects[m.MemberID] = m.Sys.Hostname
+			}
+		}
+	}
+
+	status := sensu.CheckStateOK
+	if plugin.SuspectCrit > 0 && len(suspects) >= plugin.SuspectCrit {
+		status = sensu.CheckStateCritical
+	} else if plugin.SuspectWarn > 0 && len(suspects) >= plugin.SuspectWarn {
+		status = sensu.CheckStateWarning
+	}
+
+	if status == sensu.CheckStateOK {
+		return nil
+	}
+
+	names := make([]string, 0, len(suspects))
+	for id, hostname := range suspects {
+		if hostname == "" {
+			hostname = id
+		}
+		names = append(names, hostname)
+	}
+	sort.Strings(names)
+
+	return []Finding{{
+		ServiceGroup: "ring",
+		Status:       status,
+		Message:      fmt.Sprintf("%d suspect members: %s", len(suspects), strings.Join(names, ", ")),
+	}}
+}
+
+// checkUpdateLeaders verifies that every loaded service using the rolling
+// update strategy has an elected update leader, a stuck update election is the
+// usual reason a rolling update stalls.
+func checkUpdateLeaders(census *CensusResponse, services ServiceResponse) []Finding {
+	var result []Finding
+
+	for _, svc := range services {
+		if svc.UpdateStrategy != "rolling" {
+			continue
+		}
+
+		group, ok := census.CensusGroups[svc.ServiceGroup]
+		if !ok {
+			result = append(result, Finding{
+				ServiceGroup: svc.ServiceGroup,
+				Status:       sensu.CheckStateWarning,
+				Message:      "service group missing from census, cannot verify update leader",
+			})
+			continue
+		}
+
+		// with --election-grace an unfinished election is only reported once
+		// it outlasts the grace
+		if electionGrace > 0 && !electionSettled(group.UpdateElectionStatus) {
+			continue
+		}
+
+		switch group.UpdateElectionStatus {
+		case "ElectionNoQuorum":
+			result = append(result, Finding{
+				ServiceGroup: svc.ServiceGroup,
+				Status:       sensu.CheckStateCritical,
+				Message:      "update election has no quorum",
+			})
+			continue
+		case "ElectionInProgress":
+			if !group.hasUpdateLeader() {
+				result = append(result, Finding{
+					ServiceGroup: svc.ServiceGroup,
+					Status:       sensu.CheckStateWarning,
+					Message:      "update election in progress without an update leader",
+				})
+			}
+			continue
+		}
+
+		if !group.hasUpdateLeader() {
+			result = append(result, Finding{
+				ServiceGroup: svc.ServiceGroup,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("no alive update leader (update election status %s)", group.UpdateElectionStatus),
+			})
+		}
+	}
+
+	return result
+}
+
+func (g CensusGroup) hasUpdateLeader() bool {
+	for _, m := range g.Population {
+		if m.Alive && m.UpdateLeader {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGroups turns the per member health of a service group into a service
+// level check, the group passes when enough of its members report OK.
+func checkGroups(census *CensusResponse, client *http.Client) []Finding {
+	var result []Finding
+
+	groups := make([]string, 0, len(groupChecks))
+	for group := range groupChecks {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		required := groupChecks[group]
+
+		total := 0
+		ok := 0
+		for _, m := range census.CensusGroups[group].Population {
+			if m.Departed {
+				continue
+			}
+			total++
+
+			if m.Alive && checkService(m.gatewayURL(), group, client).Status == sensu.CheckStateOK {
+				ok++
+			}
+		}
+
+		percent := 0
+		if total > 0 {
+			percent = ok * 100 / total
+		}
+
+		if total == 0 {
+			result = append(result, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateCritical,
+				Message:      fmt.Sprintf("no members in the census, required %d%% OK", required),
+			})
+		} else if percent < required {
+			result = append(result, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateCritical,
+				Message:      fmt.Sprintf("%d of %d members OK (%d%%), required %d%%", ok, total, percent, required),
+			})
+		}
+	}
+
+	return result
+}
+
+// scopeCensus returns the census narrowed to the member memberID, keeping only
+// the groups it belongs to. An empty memberID returns the census unchanged.
+func scopeCensus(census *CensusResponse, memberID string) (*CensusResponse, error) {
+	if memberID == "" {
+		return census, nil
+	}
+
+	scoped := &CensusResponse{CensusGroups: map[string]CensusGroup{}}
+	for name, group := range census.CensusGroups {
+		member, ok := group.Population[memberID]
+		if !ok {
+			continue
+		}
+		group.Population = map[string]CensusMember{memberID: member}
+		scoped.CensusGroups[name] = group
+	}
+
+	if len(scoped.CensusGroups) == 0 {
+		return nil, fmt.Errorf("member %s is not part of any census group", memberID)
+	}
+
+	return scoped, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// cloudWatchDimensions holds the parsed --cloudwatch-dimension values.
+var cloudWatchDimensions map[string]string
+
+type cloudWatchDatum struct {
+	Name       string
+	Value      float64
+	Unit       string
+	Dimensions map[string]string
+}
+
+// publishCloudWatch sends the health of each service and the per status
+// counts to CloudWatch with PutMetricData.
+func publishCloudWatch(health []Health) error {
+	client := &http.Client{Timeout: time.Duration(plugin.Timeout) * time.Second}
+
+	region, err := getAWSRegion(client, plugin.CloudWatchRegion)
+	if err != nil {
+		return err
+	}
+
+	creds, err := getAWSCredentials(client)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{"ServicesOK": 0, "ServicesWarning": 0, "ServicesCritical": 0, "ServicesUnknown": 0}
+	var data []cloudWatchDatum
+	for _, h := range health {
+		dims := map[string]string{"ServiceGroup": h.ServiceGroup}
+		for k, v := range cloudWatchDimensions {
+			dims[k] = v
+		}
+		data = append(data, cloudWatchDatum{Name: "ServiceHealth", Value: float64(h.Status), Unit: "None", Dimensions: dims})
+
+		switch h.Status {
+		case sensu.CheckStateOK:
+			counts["ServicesOK"]++
+		case sensu.CheckStateWarning:
+			counts["ServicesWarning"]++
+		case sensu.CheckStateCritical:
+			counts["ServicesCritical"]++
+		default:
+			counts["ServicesUnknown"]++
+		}
+	}
+	for _, name := range []string{"ServicesOK", "ServicesWarning", "ServicesCritical", "ServicesUnknown"} {
+		data = append(data, cloudWatchDatum{Name: name, Value: float64(counts[name]), Unit: "Count", Dimensions: cloudWatchDimensions})
+	}
+
+	// stay within the per request limit of the API
+	for len(data) > 0 {
+		n := len(data)
+		if n > 20 {
+			n = 20
+		}
+		if err := putMetricData(client, creds, region, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+
+	return nil
+}
+
+func putMetricData(client *http.Client, creds *awsCredentials, region string, data []cloudWatchDatum) error {
+	form := url.Values{}
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("Namespace", plugin.CloudWatchNamespace)
+
+	for i, d := range data {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"MetricName", d.Name)
+		form.Set(prefix+"Value", strconv.FormatFloat(d.Value, 'f', -1, 64))
+		form.Set(prefix+"Unit", d.Unit)
+
+		j := 1
+		for _, k := range sortedKeys(d.Dimensions) {
+			dim := prefix + "Dimensions.member." + strconv.Itoa(j) + "."
+			form.Set(dim+"Name", k)
+			form.Set(dim+"Value", d.Dimensions[k])
+			j++
+		}
+	}
+
+	body := []byte(form.Encode())
+	req, err := http.NewRequest("POST", "https://monitoring."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSv4(req, body, creds, region, "monitoring", time.Now())
+
+	if _, err := doText(client, req); err != nil {
+		return fmt.Errorf("PutMetricData failed: %v", err)
+	}
+
+	return nil
+}
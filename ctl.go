@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ctlPort is the port of the supervisor control gateway hab svc talks to.
+const ctlPort = "9632"
+
+// habSvc runs hab svc <action> <pkg> against the supervisor serving the
+// gateway at gatewayURL, bounded by --timeout so a hung hab cannot block the
+// run. A supervisor on another host is reached with --remote-sup.
+func habSvc(gatewayURL, action, pkg string) ([]byte, error) {
+	args := []string{"svc", action, pkg}
+
+	remote, err := remoteSup(gatewayURL)
+	if err != nil {
+		return nil, err
+	}
+	if remote != "" {
+		args = append(args, "--remote-sup", remote)
+	}
+
+	ctx := context.Background()
+	if plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plugin.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "hab", args...)
+
+	// a local supervisor's secret is found by hab itself, a remote one
+	// cannot be reached without it
+	secret, err := ctlSecret()
+	if err != nil && remote != "" {
+		return nil, fmt.Errorf("no control gateway secret for %s: %v", remote, err)
+	}
+	if secret != "" {
+		cmd.Env = append(os.Environ(), "HAB_CTL_SECRET="+secret)
+	}
+
+	return cmd.CombinedOutput()
+}
+
+// ctlSecret returns the control gateway secret the way the hab CLI looks it
+// up: HAB_CTL_SECRET, then the supervisor's CTL_SECRET file.
+func ctlSecret() (string, error) {
+	if secret := os.Getenv("HAB_CTL_SECRET"); secret != "" {
+		return secret, nil
+	}
+
+	path := plugin.CtlSecretFile
+	if path == "" {
+		path = filepath.Join(plugin.HabRoot, "sup", "default", "CTL_SECRET")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// remoteSup returns the control gateway address of the supervisor serving
+// gatewayURL, or nothing when it runs on this host.
+func remoteSup(gatewayURL string) (string, error) {
+	u, err := url.Parse(gatewayURL)
+	if err != nil {
+		return "", err
+	}
+	if isLoopback(u.Hostname()) {
+		return "", nil
+	}
+	return net.JoinHostPort(u.Hostname(), ctlPort), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugTransport writes every request and response exchanged with the
+// gateway to w, so responses from an incompatible supervisor can be captured
+// from the field.
+type debugTransport struct {
+	next http.RoundTripper
+	w    io.Writer
+	mu   sync.Mutex
+}
+
+// credentialHeaders are replaced in the dump, matched case-insensitively.
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Consul-Token",
+	"X-Vault-Token",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// redactHeader returns a copy of h with the values of credential headers
+// replaced.
+func redactHeader(h http.Header) http.Header {
+	redacted := h.Clone()
+	for name := range redacted {
+		for _, c := range credentialHeaders {
+			if strings.EqualFold(name, c) {
+				redacted[name] = []string{"REDACTED"}
+			}
+		}
+	}
+	return redacted
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dumpReq := req.Clone(req.Context())
+	dumpReq.Header = redactHeader(req.Header)
+	reqDump, err := httputil.DumpRequestOut(dumpReq, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, ">>> %s\n%s\n", time.Now().Format(time.RFC3339), reqDump)
+	if err != nil {
+		fmt.Fprintf(t.w, "<<< %v\n\n", err)
+		return nil, err
+	}
+
+	// DumpResponse replaces the body it consumes, the caller still reads it
+	dumpResp := *resp
+	dumpResp.Header = redactHeader(resp.Header)
+	respDump, dumpErr := httputil.DumpResponse(&dumpResp, true)
+	resp.Body = dumpResp.Body
+	if dumpErr != nil {
+		fmt.Fprintf(t.w, "<<< failed to dump response: %v\n\n", dumpErr)
+		return resp, nil
+	}
+	fmt.Fprintf(t.w, "<<<\n%s\n\n", respDump)
+
+	return resp, nil
+}
+
+// openDebugRaw opens the --debug-raw destination, "-" writes to stderr. The
+// returned function flushes and closes it once the run is over.
+func openDebugRaw(path string) (io.Writer, func(), error) {
+	if path == "-" {
+		return os.Stderr, func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() {
+		f.Sync()
+		f.Close()
+	}, nil
+}
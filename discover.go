@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// discoveryEnabled reports whether any discovery source is configured, in
+// which case the check fans out to every discovered supervisor instead of
+// checking --supervisor-url.
+func discoveryEnabled() bool {
+	return plugin.DiscoverSRV != "" || plugin.DiscoverConsul != "" || plugin.DiscoverK8s != "" || plugin.DiscoverEC2
+}
+
+// discoverSupervisors resolves the configured discovery sources into the
+// sorted, deduplicated gateway URLs to check.
+func discoverSupervisors(client *http.Client) ([]string, error) {
+	var endpoints []string
+
+	if plugin.DiscoverSRV != "" {
+		found, err := discoverSRV(plugin.DiscoverSRV)
+		if err != nil {
+			return nil, fmt.Errorf("SRV discovery of %s failed: %v", plugin.DiscoverSRV, err)
+		}
+		endpoints = append(endpoints, found...)
+	}
+
+	if plugin.DiscoverConsul != "" {
+		found, err := discoverConsul(client, plugin.ConsulAddress, plugin.DiscoverConsul)
+		if err != nil {
+			return nil, fmt.Errorf("Consul discovery of %s failed: %v", plugin.DiscoverConsul, err)
+		}
+		endpoints = append(endpoints, found...)
+	}
+
+	if plugin.DiscoverK8s != "" {
+		found, err := discoverKubernetes(plugin.DiscoverK8s, plugin.K8sSelector, plugin.K8sGatewayPort)
+		if err != nil {
+			return nil, fmt.Errorf("Kubernetes discovery in namespace %s failed: %v", plugin.DiscoverK8s, err)
+		}
+		endpoints = append(endpoints, found...)
+	}
+
+	if plugin.DiscoverEC2 {
+		found, err := discoverEC2(ec2Filters, plugin.EC2Region, plugin.EC2GatewayPort)
+		if err != nil {
+			return nil, fmt.Errorf("EC2 discovery failed: %v", err)
+		}
+		endpoints = append(endpoints, found...)
+	}
+
+	scheme := discoveryScheme()
+	seen := map[string]bool{}
+	var urls []string
+	for _, e := range endpoints {
+		u := scheme + "://" + e
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+
+	return urls, nil
+}
+
+// discoveryScheme is the scheme of --supervisor-url, discovered gateways are
+// expected to be configured alike. Without one plain HTTP is assumed, probing
+// every discovered gateway for TLS would double the requests.
+func discoveryScheme() string {
+	if schemeOmitted {
+		return "http"
+	}
+	if u, err := url.Parse(plugin.SupervisorURL); err == nil && u.Scheme != "" {
+		return u.Scheme
+	}
+	return "http"
+}
+
+// discoverSRV resolves an SRV record such as _habitat-http._tcp.example.com
+// into host:port endpoints.
+func discoverSRV(name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+	}
+
+	return endpoints, nil
+}
+
+// consulCatalogService is the part of a Consul catalog entry needed to reach
+// the gateway.
+type consulCatalogService struct {
+	Address        string `json:"Address"`
+	ServiceAddress string `json:"ServiceAddress"`
+	ServicePort    int    `json:"ServicePort"`
+}
+
+// discoverConsul lists the instances of a service, given as "name" or
+// "name:tag", from the Consul catalog at address.
+func discoverConsul(client *http.Client, address string, service string) ([]string, error) {
+	name, tag := service, ""
+	if i := strings.Index(service, ":"); i >= 0 {
+		name, tag = service[:i], service[i+1:]
+	}
+
+	// CONSUL_HTTP_ADDR is commonly set without a scheme
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	u := strings.TrimSuffix(address, "/") + "/v1/catalog/service/" + url.PathEscape(name)
+	if tag != "" {
+		u += "?tag=" + url.QueryEscape(tag)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if plugin.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", plugin.ConsulToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var entries []consulCatalogService
+	if err := decodeJSON(resp, &entries, "catalog"); err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(entries))
+	for _, e := range entries {
+		// the service address is optional, the node address applies then
+		host := e.ServiceAddress
+		if host == "" {
+			host = e.Address
+		}
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(e.ServicePort)))
+	}
+
+	return endpoints, nil
+}
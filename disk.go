@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// checkHabDisk returns a finding when the filesystem holding --hab-root is
+// fuller than --hab-disk-warn or --hab-disk-crit.
+func checkHabDisk() []Finding {
+	used, err := diskUsage(plugin.HabRoot)
+	if err != nil {
+		return []Finding{{
+			ServiceGroup: plugin.HabRoot,
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("failed to read disk usage: %v", err),
+		}}
+	}
+
+	addMetric("habitat_disk_used_percent", used, map[string]string{"path": plugin.HabRoot})
+
+	status := sensu.CheckStateOK
+	threshold := 0
+	if plugin.HabDiskCrit > 0 && used >= float64(plugin.HabDiskCrit) {
+		status, threshold = sensu.CheckStateCritical, plugin.HabDiskCrit
+	} else if plugin.HabDiskWarn > 0 && used >= float64(plugin.HabDiskWarn) {
+		status, threshold = sensu.CheckStateWarning, plugin.HabDiskWarn
+	}
+
+	if status == sensu.CheckStateOK {
+		return nil
+	}
+
+	return []Finding{{
+		ServiceGroup: plugin.HabRoot,
+		Status:       status,
+		Message:      fmt.Sprintf("filesystem %.1f%% used, threshold %d%%", used, threshold),
+	}}
+}
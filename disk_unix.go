@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// diskUsage returns the used percentage of the filesystem holding path, the
+// way df computes it with the blocks reserved for root left out.
+func diskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	used := uint64(st.Blocks) - uint64(st.Bfree)
+	total := used + uint64(st.Bavail)
+	if total == 0 {
+		return 0, nil
+	}
+
+	return float64(used) * 100 / float64(total), nil
+}
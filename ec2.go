@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ec2Filters holds the parsed --ec2-tag values.
+var ec2Filters map[string]string
+
+type describeInstancesResponse struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIPAddress string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// discoverEC2 lists the private addresses of the running instances carrying
+// every tag in tags, and returns their gateway endpoints.
+func discoverEC2(tags map[string]string, region string, port int) ([]string, error) {
+	client := &http.Client{Timeout: time.Duration(plugin.Timeout) * time.Second}
+
+	region, err := getAWSRegion(client, region)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := getAWSCredentials(client)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("Action", "DescribeInstances")
+	form.Set("Version", "2016-11-15")
+	form.Set("Filter.1.Name", "instance-state-name")
+	form.Set("Filter.1.Value.1", "running")
+	i := 2
+	for _, k := range sortedKeys(tags) {
+		form.Set("Filter."+strconv.Itoa(i)+".Name", "tag:"+k)
+		form.Set("Filter."+strconv.Itoa(i)+".Value.1", tags[k])
+		i++
+	}
+
+	var endpoints []string
+	for {
+		body := []byte(form.Encode())
+		req, err := http.NewRequest("POST", "https://ec2."+region+".amazonaws.com/", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		signAWSv4(req, body, creds, region, "ec2", time.Now())
+
+		text, err := doText(client, req)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeInstances failed: %v", err)
+		}
+
+		var result describeInstancesResponse
+		if err := xml.Unmarshal([]byte(text), &result); err != nil {
+			return nil, fmt.Errorf("failed to decode DescribeInstances response: %v", err)
+		}
+
+		for _, r := range result.Reservations {
+			for _, inst := range r.Instances {
+				if inst.PrivateIPAddress != "" {
+					endpoints = append(endpoints, net.JoinHostPort(inst.PrivateIPAddress, strconv.Itoa(port)))
+				}
+			}
+		}
+
+		if result.NextToken == "" {
+			return endpoints, nil
+		}
+		form.Set("NextToken", result.NextToken)
+	}
+}
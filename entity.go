@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sensu/sensu-go/types"
+)
+
+// readStdinEvent decodes the event the agent passes on stdin to checks
+// defined with stdin: true.
+func readStdinEvent(r io.Reader) (*types.Event, error) {
+	event := &types.Event{}
+	if err := json.NewDecoder(r).Decode(event); err != nil {
+		return nil, fmt.Errorf("failed to decode event from stdin, is the check defined with stdin: true? %v", err)
+	}
+	if event.Entity == nil {
+		return nil, fmt.Errorf("event on stdin has no entity")
+	}
+	return event, nil
+}
+
+// entityServices maps the entity of an event to service groups, from the
+// label named by --services-label (separated by ";" or ",") and from the
+// subscriptions starting with --services-subscription-prefix.
+func entityServices(entity *types.Entity, label string, prefix string) []string {
+	var services []string
+
+	if label != "" {
+		if value, ok := entity.Labels[label]; ok {
+			services = append(services, splitList(strings.Split(value, ";"))...)
+		}
+	}
+
+	if prefix != "" {
+		for _, sub := range entity.Subscriptions {
+			if strings.HasPrefix(sub, prefix) && len(sub) > len(prefix) {
+				services = append(services, strings.TrimPrefix(sub, prefix))
+			}
+		}
+	}
+
+	return services
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// supervisorEntity names the proxy entity of a supervisor, its hostname when
+// known and the host of its URL otherwise.
+func supervisorEntity(r SupervisorResult) string {
+	if r.Hostname != "" {
+		return r.Hostname
+	}
+	if u, err := url.Parse(r.URL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return r.URL
+}
+
+// supervisorAnnotations describes a supervisor in event annotations, so an
+// event can be correlated to its ring member.
+func supervisorAnnotations(sys *SysInfo) map[string]string {
+	if sys == nil {
+		return nil
+	}
+	return map[string]string{
+		"habitat_supervisor_version":   sys.Version,
+		"habitat_supervisor_member_id": sys.MemberID,
+		"habitat_supervisor_hostname":  sys.Hostname,
+		"habitat_supervisor_ip":        sys.IP,
+		"habitat_supervisor_gossip":    net.JoinHostPort(sys.GossipIP, strconv.Itoa(sys.GossipPort)),
+		"habitat_supervisor_http":      net.JoinHostPort(sys.HTTPGatewayIP, strconv.Itoa(sys.HTTPGatewayPort)),
+	}
+}
+
+// sendSupervisorEvents posts one result per supervisor to the agent events
+// API, each against a proxy entity for the supervisor so silencing and
+// history apply per node.
+func sendSupervisorEvents(results []SupervisorResult, name string) error {
+	client := &http.Client{Timeout: time.Duration(plugin.Timeout) * time.Second}
+	endpoint := strings.TrimSuffix(plugin.AgentAPIURL, "/") + "/events"
+
+	for _, r := range results {
+		var output bytes.Buffer
+		printSupervisor(&output, r)
+
+		body, err := json.Marshal(map[string]interface{}{
+			"check": map[string]interface{}{
+				"metadata":          map[string]interface{}{"name": name, "labels": extraLabels, "annotations": supervisorAnnotations(r.Sys)},
+				"status":            r.Status,
+				"output":            output.String(),
+				"proxy_entity_name": supervisorEntity(r),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := postJSON(client, endpoint, body, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
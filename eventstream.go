@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// natsPort is where the event stream connects when --event-stream-url has
+// no port.
+const natsPort = "4222"
+
+// checkEventStream verifies hab-sup was started with the event stream
+// configured and that its NATS endpoint accepts connections, Chef Automate's
+// application dashboard goes quiet without either.
+func checkEventStream() []Finding {
+	args, err := supervisorArgs()
+	if err != nil {
+		return []Finding{{ServiceGroup: "hab-sup", Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+
+	var missing []string
+	for _, flag := range []string{"--event-stream-url", "--event-stream-application", "--event-stream-environment"} {
+		if supervisorFlag(args, flag) == "" {
+			missing = append(missing, flag)
+		}
+	}
+	if len(missing) > 0 {
+		return []Finding{{
+			ServiceGroup: "hab-sup",
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("event stream not configured, started without %s", strings.Join(missing, ", ")),
+		}}
+	}
+
+	addr := supervisorFlag(args, "--event-stream-url")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, natsPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return []Finding{{
+			ServiceGroup: "hab-sup",
+			Status:       sensu.CheckStateCritical,
+			Message:      fmt.Sprintf("event stream endpoint %s unreachable: %v", addr, err),
+		}}
+	}
+	conn.Close()
+
+	return nil
+}
+
+// supervisorFlag returns the value of a long flag given either as
+// --flag=value or as --flag value.
+func supervisorFlag(args []string, flag string) string {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, flag+"=") {
+			return strings.TrimPrefix(arg, flag+"=")
+		}
+		if arg == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
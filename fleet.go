@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// SupervisorResult is the outcome of checking one supervisor when fanning out
+// to several.
+type SupervisorResult struct {
+	URL    string
+	Status int
+	Health []Health
+
+	// Hostname is set when the supervisor reported it with its services
+	Hostname string
+
+	// Sys holds the supervisor details when it reported them
+	Sys *SysInfo
+
+	// Error is set when the supervisor could not be checked at all
+	Error error
+
+	// Reason explains a status that differs from the checked one
+	Reason string
+}
+
+// executeFleet checks every discovered supervisor and rolls them up into a
+// single result, one line per supervisor.
+func executeFleet(client *http.Client, name string) (int, error) {
+	urls, err := discoverSupervisors(client)
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+
+	if len(urls) == 0 {
+		fmt.Fprintf(out, "No supervisors discovered")
+		return sensu.CheckStateWarning, nil
+	}
+
+	results := make([]SupervisorResult, len(urls))
+	limit := make(chan struct{}, atLeastOne(plugin.MaxSupervisors))
+	var wg sync.WaitGroup
+
+	for i, u := range urls {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i] = checkSupervisor(u, client)
+			<-limit
+		}(i, u)
+	}
+
+	wg.Wait()
+
+	applyUnreachableTolerance(results)
+
+	statuses := make([]int, 0, len(results))
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+		addMetric("habitat_supervisor_status", float64(r.Status), map[string]string{"supervisor": r.URL})
+	}
+
+	status := rollupStrategy.rollup(statuses)
+
+	// the supervisors report for themselves, the fan out itself is only
+	// degraded when the events cannot be delivered
+	if plugin.SupervisorEvents {
+		if err := sendSupervisorEvents(results, name); err != nil {
+			fmt.Fprintf(out, "Failed to send per supervisor events, reporting the merged result: %v\n", err)
+		} else {
+			fmt.Fprintf(out, "Sent results of %d supervisors as separate events", len(results))
+			return sensu.CheckStateOK, nil
+		}
+	}
+
+	if plugin.Quiet && plugin.MetricsFormat == "" {
+		printQuiet(status, fleetSummary(results, status))
+		return status, nil
+	}
+
+	printFleet(results)
+
+	return status, nil
+}
+
+// checkSupervisor checks the services of a single supervisor, every loaded
+// service unless --service is given.
+func checkSupervisor(baseURL string, client *http.Client) SupervisorResult {
+	result := SupervisorResult{URL: baseURL}
+
+	services := plugin.Services
+	if len(services) == 0 {
+		details, err := getServiceDetails(baseURL, client)
+		if err != nil {
+			result.Status = sensu.CheckStateCritical
+			result.Error = err
+			return result
+		}
+		for _, d := range details {
+			services = append(services, d.ServiceGroup)
+			sys := d.Sys
+			result.Sys = &sys
+			result.Hostname = sys.Hostname
+		}
+		if len(services) == 0 {
+			result.Status, _ = parseSeverity(plugin.EmptyServicesSeverity)
+			result.Reason = "no services loaded"
+			return result
+		}
+	}
+
+	// the event needs a name for the node even when the services were given
+	if plugin.SupervisorEvents && result.Hostname == "" {
+		if sys, err := getSupervisorSys(baseURL, client); err == nil && sys != nil {
+			result.Sys = sys
+			result.Hostname = sys.Hostname
+		}
+	}
+
+	result.Health = checkServices(baseURL, services, client)
+	applyExpectedStatus(result.Health)
+	applyDecodeErrors(result.Health)
+	applyErrorBudget(result.Health)
+	result.Status = overallStatus(result.Health, nil)
+
+	return result
+}
+
+func printFleet(results []SupervisorResult) {
+	for _, r := range results {
+		printSupervisor(out, r)
+	}
+}
+
+func printSupervisor(w io.Writer, r SupervisorResult) {
+	if r.Error != nil {
+		if r.Reason != "" {
+			fmt.Fprintf(w, "%s %s (%s): %v\n", r.URL, statusName(r.Status), r.Reason, r.Error)
+		} else {
+			fmt.Fprintf(w, "%s %s: %v\n", r.URL, statusName(r.Status), r.Error)
+		}
+		return
+	}
+
+	if r.Reason != "" {
+		fmt.Fprintf(w, "%s %s (%s): %d services\n", r.URL, statusName(r.Status), r.Reason, len(r.Health))
+	} else {
+		fmt.Fprintf(w, "%s %s: %d services\n", r.URL, statusName(r.Status), len(r.Health))
+	}
+	for _, h := range r.Health {
+		if h.Status == sensu.CheckStateOK {
+			continue
+		}
+		line := fmt.Sprintf("  %s %s", h.ServiceGroup, statusName(h.Status))
+		if h.Reason != "" {
+			line += " (" + h.Reason + ")"
+		} else if h.Error != nil {
+			line += ": " + oneLine(h.Error.Error())
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// applyUnreachableTolerance reports unreachable supervisors as WARNING as
+// long as there are no more of them than --unreachable-tolerance, so a single
+// host being down does not page for the whole fleet.
+func applyUnreachableTolerance(results []SupervisorResult) {
+	var unreachable []int
+	for i, r := range results {
+		if isUnreachable(r) {
+			unreachable = append(unreachable, i)
+		}
+	}
+
+	if len(unreachable) == 0 || len(unreachable) > plugin.UnreachableTolerance {
+		return
+	}
+
+	for _, i := range unreachable {
+		results[i].Status = sensu.CheckStateWarning
+		results[i].Reason = fmt.Sprintf("unreachable, %d of %d tolerated", len(unreachable), plugin.UnreachableTolerance)
+	}
+}
+
+// isUnreachable reports whether a supervisor could not be reached, either
+// while listing its services or, with --service, for every service checked.
+func isUnreachable(r SupervisorResult) bool {
+	if r.Error != nil {
+		return isTransportError(r.Error)
+	}
+	if len(r.Health) == 0 {
+		return false
+	}
+	for _, h := range r.Health {
+		if !isTransportError(h.Error) {
+			return false
+		}
+	}
+	return true
+}
+
+// fleetSummary describes a fan out run in a single line for --quiet.
+func fleetSummary(results []SupervisorResult, status int) string {
+	counts := map[int]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	return fmt.Sprintf("%s: %d supervisors (%d ok, %d warning, %d critical)", statusName(status), len(results),
+		counts[sensu.CheckStateOK], counts[sensu.CheckStateWarning], counts[sensu.CheckStateCritical])
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// excerptSize is how much of a response body ends up in errors.
+const excerptSize = 256
+
+// gatewayError describes a gateway response that could not be used, with
+// enough of the request and response to act on it without reaching for curl.
+type gatewayError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Message    string
+	Body       string
+}
+
+func (e *gatewayError) Error() string {
+	s := e.Method + " " + e.URL + ": " + e.Status
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.Body != "" {
+		s += " (body: " + e.Body + ")"
+	}
+	return s
+}
+
+func newGatewayError(resp *http.Response, message string, body string) *gatewayError {
+	return &gatewayError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		Body:       body,
+	}
+}
+
+// authError is returned for requests the gateway rejected with 401 or 403.
+type authError struct {
+	*gatewayError
+}
+
+// decodeError is returned for responses that could not be decoded as the
+// expected payload, a supervisor speaking another API rather than a sick
+// service.
+type decodeError struct {
+	*gatewayError
+}
+
+func (e *decodeError) Error() string {
+	return "unexpected supervisor response: " + e.gatewayError.Error()
+}
+
+// gatewayGet sends a GET request to a supervisor HTTP gateway. Responses
+// rejecting the credentials are turned into an authError, any other response
+// is returned for the caller to interpret and close.
+func gatewayGet(client *http.Client, url string) (resp *http.Response, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if plugin.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+plugin.AuthToken)
+	}
+
+	if plugin.Trace {
+		var done func(error)
+		req, done = withTrace(req)
+		defer func() { done(err) }()
+	}
+
+	if gatewayRate != nil {
+		gatewayRate.wait()
+	}
+
+	start := time.Now()
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	recordLatency(url, time.Since(start))
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		defer resp.Body.Close()
+		return nil, &authError{newGatewayError(resp, "gateway authentication required, configure --auth-token", bodyExcerpt(resp.Body))}
+	case http.StatusForbidden:
+		defer resp.Body.Close()
+		return nil, &authError{newGatewayError(resp, "gateway authentication denied, check --auth-token", bodyExcerpt(resp.Body))}
+	}
+
+	return resp, nil
+}
+
+// gatewayRate paces gateway requests to --max-rps when set.
+var gatewayRate *rateLimit
+
+// rateLimit spaces callers at least interval apart, shared by every worker.
+type rateLimit struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (r *rateLimit) wait() {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// checkStatus returns an error carrying the start of the body for responses
+// other than 200 OK.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return newGatewayError(resp, "", bodyExcerpt(resp.Body))
+}
+
+// decodeJSON decodes a gateway response into v. Anything that is not JSON,
+// such as an HTML error page from a proxy, is reported with its status,
+// content type and the start of its body rather than as a decode failure.
+func decodeJSON(resp *http.Response, v interface{}, what string) error {
+	ct := resp.Header.Get("Content-Type")
+
+	// older gateways do not always set a content type, give those the
+	// benefit of the doubt
+	if ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+			return newGatewayError(resp, fmt.Sprintf("unexpected response, content-type %q", ct), bodyExcerpt(resp.Body))
+		}
+	}
+
+	// keep what the decoder consumed so a failure can show it
+	var head bytes.Buffer
+	body := io.TeeReader(resp.Body, &limitedWriter{w: &head, n: excerptSize})
+
+	dec := json.NewDecoder(body)
+	var err error
+	if sd, ok := v.(streamDecoder); ok {
+		err = sd.decodeStream(dec)
+	} else {
+		err = dec.Decode(v)
+	}
+	if err != nil {
+		// a payload of a different shape decodes partially at best, name the
+		// mismatch rather than the decoder's position in the stream
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			msg := fmt.Sprintf("unsupported API, %s response has a JSON %s where %s was expected", what, typeErr.Value, typeErr.Type)
+			if typeErr.Field != "" {
+				msg += " at " + typeErr.Field
+			}
+			return &decodeError{newGatewayError(resp, msg, oneLine(head.String()))}
+		}
+		return &decodeError{newGatewayError(resp, fmt.Sprintf("failed to decode %s response: %v", what, err), oneLine(head.String()))}
+	}
+
+	// unknown fields are ignored and missing ones left zero, which lets a
+	// payload from another API flavor through as an empty result
+	if sc, ok := v.(shapeChecker); ok {
+		if err := sc.checkShape(); err != nil {
+			return &decodeError{newGatewayError(resp, fmt.Sprintf("unsupported supervisor API, %s response %v", what, err), oneLine(head.String()))}
+		}
+	}
+
+	return nil
+}
+
+// streamDecoder is implemented by responses large enough that they are
+// walked token by token, keeping only the fields the check uses.
+type streamDecoder interface {
+	decodeStream(dec *json.Decoder) error
+}
+
+// expectDelim reads the next token and fails unless it is delim. A null is
+// reported with ok false so optional objects can be left unset.
+func expectDelim(dec *json.Decoder, delim json.Delim, field string, typ reflect.Type) (ok bool, err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	if tok == nil {
+		return false, nil
+	}
+	if d, isDelim := tok.(json.Delim); isDelim && d == delim {
+		return true, nil
+	}
+	return false, &json.UnmarshalTypeError{Value: tokenKind(tok), Type: typ, Field: field}
+}
+
+// skipValue discards the next value, however deeply nested, without
+// buffering it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// tokenKind names the JSON type of a token the way json.UnmarshalTypeError
+// does.
+func tokenKind(tok json.Token) string {
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			return "array"
+		}
+		return "object"
+	case bool:
+		return "bool"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "null"
+}
+
+// shapeChecker is implemented by gateway responses that can tell a payload
+// they do not understand from a legitimately empty one.
+type shapeChecker interface {
+	checkShape() error
+}
+
+// bodyExcerpt reads the start of a body for error messages.
+func bodyExcerpt(body io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, excerptSize))
+	return oneLine(string(data))
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// limitedWriter keeps the first n bytes written to it and discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		keep := p
+		if len(keep) > l.n {
+			keep = keep[:l.n]
+		}
+		l.w.Write(keep)
+		l.n -= len(keep)
+	}
+	return len(p), nil
+}
@@ -1,9 +1,10 @@
 module github.com/alasconnect/sensu-habitat-check
 
-go 1.14
+go 1.17
 
 require (
 	github.com/sensu-community/sensu-plugin-sdk v0.11.0
 	github.com/sensu/sensu-go/api/core/v2 v2.3.0
 	github.com/sensu/sensu-go/types v0.3.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
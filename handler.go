@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// handlerAnnotation returns the value of the handler annotation named key,
+// looked up on the check first and the entity second, e.g.
+// sensu.io/plugins/sensu-habitat-check/config/service-group.
+func handlerAnnotation(check map[string]string, entity map[string]string, key string) string {
+	key = plugin.Keyspace + "/" + key
+	if v := check[key]; v != "" {
+		return v
+	}
+	return entity[key]
+}
+
+// executeHandler runs as a Sensu handler: it reads the event from stdin and
+// restarts or unloads the service groups named by its service-group
+// annotation with hab svc, on the supervisor the event came from.
+func executeHandler(client *http.Client) (int, error) {
+	event, err := readStdinEvent(os.Stdin)
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+
+	if event.Check == nil || event.Entity == nil {
+		return sensu.CheckStateCritical, fmt.Errorf("event on stdin has no check or entity")
+	}
+	if event.Check.Status == sensu.CheckStateOK {
+		fmt.Fprintf(out, "Check %s is OK, nothing to do\n", event.Check.Name)
+		return sensu.CheckStateOK, nil
+	}
+
+	groups := splitList([]string{handlerAnnotation(event.Check.Annotations, event.Entity.Annotations, "service-group")})
+	if len(groups) == 0 {
+		return sensu.CheckStateCritical, fmt.Errorf("event has no %s/service-group annotation naming the service groups to act on", plugin.Keyspace)
+	}
+
+	action := plugin.HandlerAction
+	if v := handlerAnnotation(event.Check.Annotations, event.Entity.Annotations, "handler-action"); v != "" {
+		action = v
+	}
+	if action != "restart" && action != "unload" {
+		return sensu.CheckStateCritical, fmt.Errorf("handler action %q invalid, must be \"restart\" or \"unload\"", action)
+	}
+
+	gatewayURL, err := eventSupervisorURL(event.Check.Annotations, event.Entity.Annotations, event.Entity.Name)
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+
+	details, err := getServiceDetails(gatewayURL, client)
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not retrieve services: %v", err)
+	}
+	idents := map[string]string{}
+	for _, d := range details {
+		idents[d.ServiceGroup] = d.Pkg.Ident
+	}
+
+	failed := 0
+	for _, group := range groups {
+		ident, err := parseIdent(idents[group])
+		if err != nil {
+			fmt.Fprintf(out, "%s: not loaded on this supervisor, skipped\n", group)
+			continue
+		}
+
+		pkg := ident.Origin + "/" + ident.Name
+		output, err := habSvc(gatewayURL, action, pkg)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "%s: hab svc %s %s failed: %v %s\n", group, action, pkg, err, oneLine(string(output)))
+			continue
+		}
+		fmt.Fprintf(out, "%s: hab svc %s %s for event %s/%s\n", group, action, pkg, event.Entity.Name, event.Check.Name)
+	}
+
+	if failed > 0 {
+		return sensu.CheckStateCritical, fmt.Errorf("%d of %d actions failed", failed, len(groups))
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// eventSupervisorURL returns the gateway of the supervisor an event came
+// from, named by its supervisor-url annotation. Without one only an event of
+// this very host is acted on, the handler usually runs on the backend and
+// the local supervisor is someone else's.
+func eventSupervisorURL(check map[string]string, entity map[string]string, entityName string) (string, error) {
+	if v := handlerAnnotation(check, entity, "supervisor-url"); v != "" {
+		return strings.TrimSuffix(v, "/"), nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(entityName, hostname) {
+		return "", fmt.Errorf("event of %s has no %s/supervisor-url annotation, refusing to act on the supervisor of %s", entityName, plugin.Keyspace, hostname)
+	}
+
+	if schemeOmitted {
+		if err := detectScheme(); err != nil {
+			return "", err
+		}
+	}
+
+	return getSupervisorUrl(), nil
+}
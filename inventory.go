@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// InventoryReport lists what a supervisor runs, printed by the inventory
+// mode.
+type InventoryReport struct {
+	Supervisor *SysInfo           `json:"supervisor,omitempty"`
+	Services   []InventoryService `json:"services"`
+	Labels     map[string]string  `json:"labels,omitempty"`
+}
+
+type InventoryService struct {
+	ServiceGroup   string `json:"service_group"`
+	Ident          string `json:"pkg_ident"`
+	Channel        string `json:"channel,omitempty"`
+	Topology       string `json:"topology,omitempty"`
+	UpdateStrategy string `json:"update_strategy,omitempty"`
+	ProcessState   string `json:"process_state,omitempty"`
+	UptimeSeconds  int64  `json:"uptime_seconds"`
+}
+
+// executeInventory prints every loaded service with its package and update
+// settings, as JSON or as info metrics with --metrics-format.
+func executeInventory(client *http.Client) (int, error) {
+	details, err := getServiceDetails(getSupervisorUrl(), client)
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not retrieve services: %v", err)
+	}
+
+	report := buildInventory(details, time.Now())
+
+	if plugin.MetricsFormat != "" {
+		for _, s := range report.Services {
+			tags := serviceTags(s.ServiceGroup, s.Ident, s.Channel, s.Topology, s.UpdateStrategy)
+			addMetric("habitat_service_uptime_seconds", float64(s.UptimeSeconds), tags)
+
+			info := map[string]string{"pkg_ident": s.Ident}
+			for k, v := range tags {
+				info[k] = v
+			}
+			addMetric("habitat_service_info", 1, info)
+		}
+		printMetrics()
+		return sensu.CheckStateOK, nil
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("failed to encode inventory: %v", err)
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func buildInventory(details ServiceResponse, now time.Time) InventoryReport {
+	report := InventoryReport{Services: []InventoryService{}, Labels: extraLabels}
+
+	for _, d := range details {
+		if report.Supervisor == nil {
+			sys := d.Sys
+			report.Supervisor = &sys
+		}
+
+		s := InventoryService{
+			ServiceGroup:   d.ServiceGroup,
+			Ident:          d.Pkg.Ident,
+			Channel:        d.Channel,
+			Topology:       d.Topology,
+			UpdateStrategy: d.UpdateStrategy,
+			ProcessState:   d.Process.State,
+		}
+		if d.Process.StateEntered > 0 {
+			s.UptimeSeconds = int64(now.Sub(time.Unix(d.Process.StateEntered, 0)).Seconds())
+		}
+		report.Services = append(report.Services, s)
+	}
+
+	return report
+}
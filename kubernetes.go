@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+type pod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// discoverKubernetes lists the running pods in namespace matching selector
+// through the API server, using the in-cluster service account, and returns
+// their gateway endpoints.
+func discoverKubernetes(namespace string, selector string, port int) ([]string, error) {
+	host, hostPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || hostPort == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST is not set")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(plugin.Timeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	u := "https://" + net.JoinHostPort(host, hostPort) + "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	if selector != "" {
+		u += "?labelSelector=" + url.QueryEscape(selector)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var pods podList
+	if err := decodeJSON(resp, &pods, "pod list"); err != nil {
+		return nil, err
+	}
+
+	var endpoints []string
+	for _, p := range pods.Items {
+		// pending pods have no address yet and finished ones run no supervisor
+		if p.Status.Phase != "Running" || p.Status.PodIP == "" {
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(p.Status.PodIP, strconv.Itoa(port)))
+	}
+
+	return endpoints, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// entityLabels turns the loaded services into entity labels, one
+// habitat_<service>_<group>_version per service group plus habitat_services
+// listing them in the format --services-label reads. The group is part of the
+// name so app.default and app.prod on one supervisor do not overwrite each
+// other.
+func entityLabels(details ServiceResponse) map[string]string {
+	labels := map[string]string{}
+
+	var groups []string
+	for _, d := range details {
+		groups = append(groups, d.ServiceGroup)
+
+		ident, err := parseIdent(d.Pkg.Ident)
+		if err != nil {
+			continue
+		}
+		sg, err := parseServiceGroup(d.ServiceGroup)
+		if err != nil {
+			continue
+		}
+		labels["habitat_"+labelName(sg.Service)+"_"+labelName(sg.Group)+"_version"] = ident.Version
+	}
+	labels["habitat_services"] = strings.Join(groups, ";")
+
+	return labels
+}
+
+// labelName reduces a service name to the characters safe in a label name.
+func labelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, name)
+}
+
+// exportEntityLabels merges labels into the entity through the backend API,
+// removing the habitat_ labels of services no longer loaded. The agent API
+// only accepts events, labels can only be changed on the backend.
+func exportEntityLabels(labels map[string]string) error {
+	entity := plugin.SensuEntity
+	if entity == "" {
+		var err error
+		if entity, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	u := strings.TrimSuffix(plugin.SensuAPIURL, "/") + "/api/core/v2/namespaces/" + url.PathEscape(plugin.SensuNamespace) + "/entities/" + url.PathEscape(entity)
+	client := &http.Client{Timeout: time.Duration(plugin.Timeout) * time.Second}
+
+	current, err := getEntityLabels(client, u)
+	if err != nil {
+		return err
+	}
+
+	// a null in a merge patch deletes the key
+	patch := map[string]interface{}{}
+	for k := range current {
+		if _, ok := labels[k]; !ok && strings.HasPrefix(k, "habitat_") {
+			patch[k] = nil
+		}
+	}
+	for k, v := range labels {
+		patch[k] = v
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": patch},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Authorization", "Key "+plugin.SensuAPIKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PATCH entity %s: %s", entity, resp.Status)
+	}
+
+	return nil
+}
+
+// getEntityLabels returns the labels the backend currently has for the
+// entity at u.
+func getEntityLabels(client *http.Client, u string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Key "+plugin.SensuAPIKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	var entity struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entity); err != nil {
+		return nil, fmt.Errorf("failed to decode entity: %v", err)
+	}
+
+	return entity.Metadata.Labels, nil
+}
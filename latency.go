@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+var (
+	// latencyWarn and latencyCrit hold the parsed --latency-warn and
+	// --latency-crit durations, zero disables them.
+	latencyWarn time.Duration
+	latencyCrit time.Duration
+
+	slowest   gatewayLatency
+	slowestMu sync.Mutex
+)
+
+// gatewayLatency is the time a gateway request took until its response
+// headers arrived.
+type gatewayLatency struct {
+	URL      string
+	Duration time.Duration
+}
+
+// recordLatency keeps the slowest gateway request of the run.
+func recordLatency(url string, d time.Duration) {
+	slowestMu.Lock()
+	defer slowestMu.Unlock()
+
+	if d > slowest.Duration {
+		slowest = gatewayLatency{URL: url, Duration: d}
+	}
+}
+
+// checkLatency returns a finding when the slowest gateway request of the run
+// exceeded --latency-warn or --latency-crit.
+func checkLatency() []Finding {
+	slowestMu.Lock()
+	defer slowestMu.Unlock()
+
+	if slowest.URL != "" {
+		addMetric("habitat_gateway_latency_seconds", slowest.Duration.Seconds(), nil)
+	}
+
+	status := sensu.CheckStateOK
+	threshold := time.Duration(0)
+	if latencyCrit > 0 && slowest.Duration >= latencyCrit {
+		status, threshold = sensu.CheckStateCritical, latencyCrit
+	} else if latencyWarn > 0 && slowest.Duration >= latencyWarn {
+		status, threshold = sensu.CheckStateWarning, latencyWarn
+	}
+
+	if status == sensu.CheckStateOK {
+		return nil
+	}
+
+	return []Finding{{
+		ServiceGroup: "gateway",
+		Status:       status,
+		Message:      fmt.Sprintf("request to %s took %s, threshold %s", slowest.URL, slowest.Duration.Round(time.Millisecond), threshold),
+	}}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// errLocked is returned by acquireLock when another run holds the lock.
+var errLocked = errors.New("lock held by another run")
+
+// acquireLock takes the --lock-file lock, waiting up to wait for a running
+// check to finish. The returned function releases it.
+func acquireLock(path string, wait time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+
+	for {
+		release, err := tryLock(path)
+		if err != errLocked {
+			return release, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func openLockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
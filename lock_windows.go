@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// tryLock uses exclusive creation of the lock file since flock is not
+// available. A lock left behind by a run that died is taken over once it is
+// older than the longest a run could take.
+func tryLock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		info, statErr := os.Stat(path)
+		if statErr == nil && time.Since(info.ModTime()) > 2*time.Duration(plugin.Timeout)*time.Second+lockWait {
+			os.Remove(path)
+			return tryLock(path)
+		}
+		return nil, errLocked
+	} else if err != nil {
+		return nil, err
+	}
+
+	f.Close()
+
+	return func() { os.Remove(path) }, nil
+}
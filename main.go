@@ -1,216 +1,2422 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sensu-community/sensu-plugin-sdk/sensu"
 	"github.com/sensu/sensu-go/types"
+	"golang.org/x/crypto/pkcs12"
 )
 
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
-	SupervisorURL string
-	Services      []string
-	Timeout       int
+	SupervisorURL         string
+	HTTPFallback          bool
+	SSH                   string
+	SSHKey                string
+	SSHKnownHosts         string
+	ProbePorts            []string
+	DiscoverSRV           string
+	DiscoverConsul        string
+	ConsulAddress         string
+	ConsulToken           string
+	DiscoverK8s           string
+	K8sSelector           string
+	K8sGatewayPort        int
+	DiscoverEC2           bool
+	EC2Tags               []string
+	EC2Region             string
+	EC2GatewayPort        int
+	MaxSupervisors        int
+	RequestsPerSupervisor int
+	MaxRPS                int
+	Aggregate             string
+	UnreachableTolerance  int
+	SupervisorEvents      bool
+	AgentAPIURL           string
+	EventCheckName        string
+	Timeout               int
+	PreflightTimeout      string
+	LatencyWarn           string
+	LatencyCrit           string
+	FollowRedirects       bool
+	MaxRedirects          int
+	AuthToken             string
+	ClientP12             string
+	P12Password           string
+
+	Mode                  string
+	Peers                 []string
+	PeerWatchFile         string
+	Services              []string
+	ServicesLabel         string
+	ServicesSubPrefix     string
+	EntityOverrides       bool
+	HabRoot               string
+	NotRunningSeverity    string
+	AuthSeverity          string
+	EmptyServicesSeverity string
+	ConfigErrorSeverity   string
+	DecodeErrorSeverity   string
+	Weights               []string
+	ScoreWarn             int
+	ScoreCrit             int
+	ErrorBudget           int
+	ExpectStatus          []string
+	CheckInstalled        bool
+	CheckOriginKeys       bool
+	ForbidChannel         []string
+	HabDiskWarn           int
+	HabDiskCrit           int
+	MaxOldReleases        int
+	SupRSSWarn            int
+	SupRSSCrit            int
+	SupFDsWarn            int
+	SupFDsCrit            int
+	SupThreadsWarn        int
+	SupThreadsCrit        int
+	SystemdUnit           string
+	ProbeBuilder          bool
+	SecurityAudit         bool
+	CheckEventStream      bool
+	BuilderURL            string
+	BuilderToken          string
+	BuilderLatency        string
+	WarningAs             string
+	LockFile              string
+	LockWait              string
+
+	Verbose           bool
+	Quiet             bool
+	Timestamps        bool
+	DebugRaw          string
+	Trace             bool
+	SummaryJSON       bool
+	OutputFormat      string
+	LineFormat        string
+	OutputFile        string
+	OutputFileMaxSize int
+	OutputFileHeader  bool
+	MetricsFormat     string
+	Labels            []string
+	RingMetrics       bool
+
+	StateFile      string
+	EscalateAfter  string
+	FlapThreshold  int
+	FlapWindow     string
+	FlapHold       bool
+	DetectRestart  bool
+	DetectUnloaded bool
+	Remediate      bool
+	RemediateAfter int
+	HandlerAction  string
+	CtlSecretFile  string
+
+	ExpectedMembers    []string
+	SuspectWarn        int
+	SuspectCrit        int
+	UpdateLeader       bool
+	ElectionGrace      string
+	GroupChecks        []string
+	VersionTolerance   int
+	PartitionCheck     int
+	PartitionTolerance int
+	MemberID           string
+
+	ZabbixServer         string
+	ZabbixHost           string
+	WebhookURL           string
+	WebhookSecret        string
+	ShipURL              string
+	CloudWatchNamespace  string
+	CloudWatchRegion     string
+	CloudWatchDimensions []string
+	SensuAPIURL          string
+	SensuAPIKey          string
+	SensuNamespace       string
+	SensuEntity          string
+}
+
+var (
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "sensu-habitat-check",
+			Short:    "Checks habitat supervisor for service health",
+			Keyspace: "sensu.io/plugins/sensu-habitat-check/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "supervisor-url",
+			Env:       "",
+			Argument:  "supervisor-url",
+			Shorthand: "u",
+			Default:   "http://127.0.0.1:9631",
+			Usage:     "Supervisor URL, without a scheme HTTPS is tried before HTTP",
+			Value:     &plugin.SupervisorURL,
+		},
+		{
+			Path:     "http-fallback",
+			Env:      "",
+			Argument: "http-fallback",
+			Default:  true,
+			Usage:    "Fall back to HTTP when --supervisor-url has no scheme and the gateway does not speak HTTPS",
+			Value:    &plugin.HTTPFallback,
+		},
+		{
+			Path:     "ssh",
+			Env:      "",
+			Argument: "ssh",
+			Default:  "",
+			Usage:    "Reach the supervisor through an SSH tunnel to user@host[:port], --supervisor-url is then resolved on that host (e.g. a gateway bound to 127.0.0.1)",
+			Value:    &plugin.SSH,
+		},
+		{
+			Path:     "ssh-key",
+			Env:      "",
+			Argument: "ssh-key",
+			Default:  "",
+			Usage:    "Private key for --ssh, the running ssh-agent is used without it",
+			Value:    &plugin.SSHKey,
+		},
+		{
+			Path:     "ssh-known-hosts",
+			Env:      "",
+			Argument: "ssh-known-hosts",
+			Default:  "~/.ssh/known_hosts",
+			Usage:    "Known hosts file the --ssh host key is verified against",
+			Value:    &plugin.SSHKnownHosts,
+		},
+		{
+			Path:     "probe-ports",
+			Env:      "",
+			Argument: "probe-ports",
+			Default:  []string{},
+			Usage:    "Candidate gateway ports to try on the supervisor host, the first accepting connections replaces the port of --supervisor-url",
+			Value:    &plugin.ProbePorts,
+		},
+		{
+			Path:     "discover-srv",
+			Env:      "",
+			Argument: "discover-srv",
+			Default:  "",
+			Usage:    "Check every supervisor listed by this SRV record (e.g. _habitat-http._tcp.example.com) instead of --supervisor-url, using its scheme",
+			Value:    &plugin.DiscoverSRV,
+		},
+		{
+			Path:     "discover-consul",
+			Env:      "",
+			Argument: "discover-consul",
+			Default:  "",
+			Usage:    "Check every supervisor registered in the Consul catalog under this service, in format name or name:tag",
+			Value:    &plugin.DiscoverConsul,
+		},
+		{
+			Path:     "consul-address",
+			Env:      "CONSUL_HTTP_ADDR",
+			Argument: "consul-address",
+			Default:  "http://127.0.0.1:8500",
+			Usage:    "Consul HTTP API address used by --discover-consul",
+			Value:    &plugin.ConsulAddress,
+		},
+		{
+			Path:     "consul-token",
+			Env:      "CONSUL_HTTP_TOKEN",
+			Argument: "consul-token",
+			Default:  "",
+			Usage:    "Consul ACL token used by --discover-consul",
+			Value:    &plugin.ConsulToken,
+			Secret:   true,
+		},
+		{
+			Path:     "discover-k8s",
+			Env:      "",
+			Argument: "discover-k8s",
+			Default:  "",
+			Usage:    "Check every running pod in this Kubernetes namespace, using the in-cluster service account",
+			Value:    &plugin.DiscoverK8s,
+		},
+		{
+			Path:     "k8s-selector",
+			Env:      "",
+			Argument: "k8s-selector",
+			Default:  "",
+			Usage:    "Label selector limiting --discover-k8s to the pods running the supervisor (e.g. app=habitat)",
+			Value:    &plugin.K8sSelector,
+		},
+		{
+			Path:     "k8s-gateway-port",
+			Env:      "",
+			Argument: "k8s-gateway-port",
+			Default:  9631,
+			Usage:    "Gateway port of the pods found by --discover-k8s",
+			Value:    &plugin.K8sGatewayPort,
+		},
+		{
+			Path:     "discover-ec2",
+			Env:      "",
+			Argument: "discover-ec2",
+			Default:  false,
+			Usage:    "Check the private address of every running EC2 instance matching --ec2-tag",
+			Value:    &plugin.DiscoverEC2,
+		},
+		{
+			Path:     "ec2-tag",
+			Env:      "",
+			Argument: "ec2-tag",
+			Default:  []string{},
+			Usage:    "Tag the instances found by --discover-ec2 must carry, in format key=value",
+			Value:    &plugin.EC2Tags,
+		},
+		{
+			Path:     "ec2-region",
+			Env:      "",
+			Argument: "ec2-region",
+			Default:  "",
+			Usage:    "AWS region searched by --discover-ec2, defaults to AWS_REGION or the region of the EC2 instance",
+			Value:    &plugin.EC2Region,
+		},
+		{
+			Path:     "ec2-gateway-port",
+			Env:      "",
+			Argument: "ec2-gateway-port",
+			Default:  9631,
+			Usage:    "Gateway port of the instances found by --discover-ec2",
+			Value:    &plugin.EC2GatewayPort,
+		},
+		{
+			Path:     "max-supervisors",
+			Env:      "",
+			Argument: "max-supervisors",
+			Default:  10,
+			Usage:    "Maximum number of discovered supervisors checked at the same time",
+			Value:    &plugin.MaxSupervisors,
+		},
+		{
+			Path:     "requests-per-supervisor",
+			Env:      "",
+			Argument: "requests-per-supervisor",
+			Default:  1,
+			Usage:    "Maximum number of health requests in flight to a single supervisor",
+			Value:    &plugin.RequestsPerSupervisor,
+		},
+		{
+			Path:     "max-rps",
+			Env:      "",
+			Argument: "max-rps",
+			Default:  0,
+			Usage:    "Maximum gateway requests per second across all workers and supervisors, so fan outs do not saturate small gateways (0 is unlimited)",
+			Value:    &plugin.MaxRPS,
+		},
+		{
+			Path:     "aggregate",
+			Env:      "",
+			Argument: "aggregate",
+			Default:  "worst",
+			Usage:    "How discovered supervisors, or the members of a service group in aggregate mode, roll up into one status, one of worst, majority, quorum or percent:N (CRITICAL unless N% are OK)",
+			Value:    &plugin.Aggregate,
+		},
+		{
+			Path:     "unreachable-tolerance",
+			Env:      "",
+			Argument: "unreachable-tolerance",
+			Default:  0,
+			Usage:    "Number of discovered supervisors that may be unreachable and reported as WARNING, more than this are CRITICAL",
+			Value:    &plugin.UnreachableTolerance,
+		},
+		{
+			Path:     "supervisor-events",
+			Env:      "",
+			Argument: "supervisor-events",
+			Default:  false,
+			Usage:    "When checking several supervisors, send one event per supervisor against a proxy entity named after its hostname instead of a merged result",
+			Value:    &plugin.SupervisorEvents,
+		},
+		{
+			Path:     "event-check-name",
+			Env:      "",
+			Argument: "event-check-name",
+			Default:  "",
+			Usage:    "Name of the check the --supervisor-events events are sent for, usually the name of this check",
+			Value:    &plugin.EventCheckName,
+		},
+		{
+			Path:     "agent-api-url",
+			Env:      "",
+			Argument: "agent-api-url",
+			Default:  "http://127.0.0.1:3031",
+			Usage:    "Sensu agent API the --supervisor-events are sent to",
+			Value:    &plugin.AgentAPIURL,
+		},
+		{
+			Path:      "mode",
+			Env:       "",
+			Argument:  "mode",
+			Shorthand: "m",
+			Default:   "check",
+			Usage:     "Run mode, one of \"check\" (local services), \"aggregate\" (JSON rollup of every service group across the ring), \"peers\" (ring backbone of --peer permanent peers and --peer-watch-file peers), \"inventory\" (JSON or info metrics of every loaded service) or \"handler\" (Sensu handler restarting the service groups of the event on stdin)",
+			Value:     &plugin.Mode,
+		},
+		{
+			Path:     "peer",
+			Env:      "",
+			Argument: "peer",
+			Default:  []string{},
+			Usage:    "Permanent peer expected in the ring in --mode peers, in format host[:gossip_port]",
+			Value:    &plugin.Peers,
+		},
+		{
+			Path:     "peer-watch-file",
+			Env:      "",
+			Argument: "peer-watch-file",
+			Default:  "",
+			Usage:    "The supervisor's --peer-watch-file, in --mode peers every peer listed must be reachable on its gossip port, a member of the ring and present in the census",
+			Value:    &plugin.PeerWatchFile,
+		},
+		{
+			Path:      "service",
+			Env:       "",
+			Argument:  "service",
+			Shorthand: "s",
+			Default:   []string{},
+			Usage:     "Explicit service to check, in format service_name.service_group with optional application.environment# prefix and @organization suffix, repeat or separate with commas for several, \"-\" reads one per line from stdin",
+			Value:     &plugin.Services,
+		},
+		{
+			Path:     "services-label",
+			Env:      "",
+			Argument: "services-label",
+			Default:  "",
+			Usage:    "Entity label listing the services to check, separated by \";\" (e.g. habitat_services=\"app.default;db.default\"), requires the check to be defined with stdin: true",
+			Value:    &plugin.ServicesLabel,
+		},
+		{
+			Path:     "services-subscription-prefix",
+			Env:      "",
+			Argument: "services-subscription-prefix",
+			Default:  "",
+			Usage:    "Check the services named by entity subscriptions with this prefix (e.g. \"habitat:\" for habitat:app.default), requires the check to be defined with stdin: true",
+			Value:    &plugin.ServicesSubPrefix,
+		},
+		{
+			Path:     "entity-overrides",
+			Env:      "",
+			Argument: "entity-overrides",
+			Default:  false,
+			Usage:    "Apply per service settings from entity annotations (" + plugin.Keyspace + "/overrides/service_name.service_group/setting), settings are min-uptime, severity, expected-members and group-check, requires the check to be defined with stdin: true",
+			Value:    &plugin.EntityOverrides,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "t",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:     "preflight-timeout",
+			Env:      "",
+			Argument: "preflight-timeout",
+			Default:  "1s",
+			Usage:    "Connect timeout of the probe made before querying the gateway, so a dead supervisor fails fast rather than after --timeout per request, 0 disables the probe",
+			Value:    &plugin.PreflightTimeout,
+		},
+		{
+			Path:     "latency-warn",
+			Env:      "",
+			Argument: "latency-warn",
+			Default:  "",
+			Usage:    "Warn when a gateway request takes longer than this duration (e.g. 2s), even if every service is healthy",
+			Value:    &plugin.LatencyWarn,
+		},
+		{
+			Path:     "latency-crit",
+			Env:      "",
+			Argument: "latency-crit",
+			Default:  "",
+			Usage:    "Go critical when a gateway request takes longer than this duration",
+			Value:    &plugin.LatencyCrit,
+		},
+		{
+			Path:     "follow-redirects",
+			Env:      "",
+			Argument: "follow-redirects",
+			Default:  true,
+			Usage:    "Follow HTTP redirects from the gateway or a proxy in front of it",
+			Value:    &plugin.FollowRedirects,
+		},
+		{
+			Path:     "max-redirects",
+			Env:      "",
+			Argument: "max-redirects",
+			Default:  10,
+			Usage:    "Maximum number of redirects to follow per request",
+			Value:    &plugin.MaxRedirects,
+		},
+		{
+			Path:     "hab-root",
+			Env:      "",
+			Argument: "hab-root",
+			Default:  defaultHabRoot(),
+			Usage:    "Habitat root directory on the supervisor host",
+			Value:    &plugin.HabRoot,
+		},
+		{
+			Path:     "check-installed",
+			Env:      "",
+			Argument: "check-installed",
+			Default:  false,
+			Usage:    "Warn about services running an older release than the latest one installed under --hab-root, awaiting a restart",
+			Value:    &plugin.CheckInstalled,
+		},
+		{
+			Path:     "check-origin-keys",
+			Env:      "",
+			Argument: "check-origin-keys",
+			Default:  false,
+			Usage:    "Warn when the public key of a loaded service's origin is missing under --hab-root",
+			Value:    &plugin.CheckOriginKeys,
+		},
+		{
+			Path:     "forbid-channel",
+			Env:      "",
+			Argument: "forbid-channel",
+			Default:  []string{},
+			Usage:    "Warn when a loaded service tracks this channel (e.g. unstable), repeat or comma separate for several",
+			Value:    &plugin.ForbidChannel,
+		},
+		{
+			Path:     "hab-disk-warn",
+			Env:      "",
+			Argument: "hab-disk-warn",
+			Default:  0,
+			Usage:    "Warn when the filesystem holding --hab-root is at least this percent full (0 disables)",
+			Value:    &plugin.HabDiskWarn,
+		},
+		{
+			Path:     "hab-disk-crit",
+			Env:      "",
+			Argument: "hab-disk-crit",
+			Default:  0,
+			Usage:    "Go critical when the filesystem holding --hab-root is at least this percent full (0 disables)",
+			Value:    &plugin.HabDiskCrit,
+		},
+		{
+			Path:     "max-old-releases",
+			Env:      "",
+			Argument: "max-old-releases",
+			Default:  -1,
+			Usage:    "Warn about packages under --hab-root keeping more than this many releases besides the latest (-1 disables)",
+			Value:    &plugin.MaxOldReleases,
+		},
+		{
+			Path:     "sup-rss-warn",
+			Env:      "",
+			Argument: "sup-rss-warn",
+			Default:  0,
+			Usage:    "Warn when the resident memory of the hab-sup process in MB reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupRSSWarn,
+		},
+		{
+			Path:     "sup-rss-crit",
+			Env:      "",
+			Argument: "sup-rss-crit",
+			Default:  0,
+			Usage:    "Go critical when the resident memory of the hab-sup process in MB reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupRSSCrit,
+		},
+		{
+			Path:     "sup-fds-warn",
+			Env:      "",
+			Argument: "sup-fds-warn",
+			Default:  0,
+			Usage:    "Warn when the number of files the hab-sup process has open reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupFDsWarn,
+		},
+		{
+			Path:     "sup-fds-crit",
+			Env:      "",
+			Argument: "sup-fds-crit",
+			Default:  0,
+			Usage:    "Go critical when the number of files the hab-sup process has open reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupFDsCrit,
+		},
+		{
+			Path:     "sup-threads-warn",
+			Env:      "",
+			Argument: "sup-threads-warn",
+			Default:  0,
+			Usage:    "Warn when the number of threads of the hab-sup process reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupThreadsWarn,
+		},
+		{
+			Path:     "sup-threads-crit",
+			Env:      "",
+			Argument: "sup-threads-crit",
+			Default:  0,
+			Usage:    "Go critical when the number of threads of the hab-sup process reaches this (0 disables, Linux only)",
+			Value:    &plugin.SupThreadsCrit,
+		},
+		{
+			Path:     "systemd-unit",
+			Env:      "",
+			Argument: "systemd-unit",
+			Default:  "",
+			Usage:    "Cross-check the ActiveState of this systemd unit (e.g. hab-sup) against the gateway answering",
+			Value:    &plugin.SystemdUnit,
+		},
+		{
+			Path:     "probe-builder",
+			Env:      "",
+			Argument: "probe-builder",
+			Default:  false,
+			Usage:    "Verify this host can reach --builder-url, package updates stop silently without it",
+			Value:    &plugin.ProbeBuilder,
+		},
+		{
+			Path:     "security-audit",
+			Env:      "",
+			Argument: "security-audit",
+			Default:  false,
+			Usage:    "Warn when the gateway answers without an auth token or serves plaintext HTTP beyond loopback",
+			Value:    &plugin.SecurityAudit,
+		},
+		{
+			Path:     "check-event-stream",
+			Env:      "",
+			Argument: "check-event-stream",
+			Default:  false,
+			Usage:    "Verify hab-sup was started with --event-stream-url, application and environment, and that the NATS endpoint is reachable, for sites feeding Chef Automate",
+			Value:    &plugin.CheckEventStream,
+		},
+		{
+			Path:     "builder-url",
+			Env:      "HAB_BLDR_URL",
+			Argument: "builder-url",
+			Default:  "https://bldr.habitat.sh",
+			Usage:    "Builder or on-prem depot URL the supervisor updates from",
+			Value:    &plugin.BuilderURL,
+		},
+		{
+			Path:     "builder-token",
+			Env:      "HAB_AUTH_TOKEN",
+			Argument: "builder-token",
+			Default:  "",
+			Usage:    "Auth token the --probe-builder reachability probe presents to an on-prem depot at --builder-url, no other check queries Builder",
+			Value:    &plugin.BuilderToken,
+			Secret:   true,
+		},
+		{
+			Path:     "builder-latency",
+			Env:      "",
+			Argument: "builder-latency",
+			Default:  "",
+			Usage:    "Warn when the --probe-builder request takes longer than this duration (e.g. 2s)",
+			Value:    &plugin.BuilderLatency,
+		},
+		{
+			Path:     "not-running-severity",
+			Env:      "",
+			Argument: "not-running-severity",
+			Default:  "critical",
+			Usage:    "Severity when the supervisor refuses connections because it is not installed or not running, one of ok, warning, critical or unknown",
+			Value:    &plugin.NotRunningSeverity,
+		},
+		{
+			Path:      "verbose",
+			Env:       "",
+			Argument:  "verbose",
+			Shorthand: "v",
+			Default:   false,
+			Usage:     "Include supervisor details in the output",
+			Value:     &plugin.Verbose,
+		},
+		{
+			Path:      "quiet",
+			Env:       "",
+			Argument:  "quiet",
+			Shorthand: "q",
+			Default:   false,
+			Usage:     "Print nothing when OK and a one line summary otherwise, rely on the exit status for the result",
+			Value:     &plugin.Quiet,
+		},
+		{
+			Path:     "timestamps",
+			Env:      "",
+			Argument: "timestamps",
+			Default:  false,
+			Usage:    "Prefix each service line of the text output with the RFC3339 UTC time its health call completed",
+			Value:    &plugin.Timestamps,
+		},
+		{
+			Path:     "summary-json",
+			Env:      "",
+			Argument: "summary-json",
+			Default:  false,
+			Usage:    "Write a one line JSON summary of the run (counts, duration, exit status) to stderr",
+			Value:    &plugin.SummaryJSON,
+		},
+		{
+			Path:     "trace",
+			Env:      "",
+			Argument: "trace",
+			Default:  false,
+			Usage:    "Print DNS, connect, TLS and time to first byte timings of every gateway request to stderr",
+			Value:    &plugin.Trace,
+		},
+		{
+			Path:     "debug-raw",
+			Env:      "",
+			Argument: "debug-raw",
+			Default:  "",
+			Usage:    "Append raw gateway requests and responses to this file, \"-\" for stderr, the auth token is redacted",
+			Value:    &plugin.DebugRaw,
+		},
+		{
+			Path:     "lock-file",
+			Env:      "",
+			Argument: "lock-file",
+			Default:  "",
+			Usage:    "File locked for the duration of a run so overlapping runs do not query the supervisor at the same time",
+			Value:    &plugin.LockFile,
+		},
+		{
+			Path:     "lock-wait",
+			Env:      "",
+			Argument: "lock-wait",
+			Default:  "0s",
+			Usage:    "How long to wait for a running check to release --lock-file before skipping this run",
+			Value:    &plugin.LockWait,
+		},
+		{
+			Path:     "state-file",
+			Env:      "",
+			Argument: "state-file",
+			Default:  "",
+			Usage:    "File to persist service status between runs, required by the options that track status over time",
+			Value:    &plugin.StateFile,
+		},
+		{
+			Path:     "escalate-after",
+			Env:      "",
+			Argument: "escalate-after",
+			Default:  "",
+			Usage:    "Promote a service to CRITICAL once it has been WARNING for longer than this duration (e.g. 30m), requires --state-file",
+			Value:    &plugin.EscalateAfter,
+		},
+		{
+			Path:     "flap-threshold",
+			Env:      "",
+			Argument: "flap-threshold",
+			Default:  0,
+			Usage:    "Mark a service as flapping when its status changed more than this many times within --flap-window (0 disables), requires --state-file",
+			Value:    &plugin.FlapThreshold,
+		},
+		{
+			Path:     "flap-window",
+			Env:      "",
+			Argument: "flap-window",
+			Default:  "1h",
+			Usage:    "Window in which status changes are counted for --flap-threshold",
+			Value:    &plugin.FlapWindow,
+		},
+		{
+			Path:     "flap-hold",
+			Env:      "",
+			Argument: "flap-hold",
+			Default:  false,
+			Usage:    "Hold flapping services at WARNING instead of reporting every status change",
+			Value:    &plugin.FlapHold,
+		},
+		{
+			Path:     "detect-restart",
+			Env:      "",
+			Argument: "detect-restart",
+			Default:  false,
+			Usage:    "Warn once when the hab-sup process restarted since the last run (Linux only), requires --state-file",
+			Value:    &plugin.DetectRestart,
+		},
+		{
+			Path:     "detect-unloaded",
+			Env:      "",
+			Argument: "detect-unloaded",
+			Default:  false,
+			Usage:    "Warn once about service groups unloaded since the last run, requires --state-file",
+			Value:    &plugin.DetectUnloaded,
+		},
+		{
+			Path:     "remediate",
+			Env:      "",
+			Argument: "remediate",
+			Default:  false,
+			Usage:    "Restart services with hab svc restart once they have been CRITICAL for --remediate-after consecutive runs, on the checked supervisor through --remote-sup when it is not local, requires --state-file",
+			Value:    &plugin.Remediate,
+		},
+		{
+			Path:     "remediate-after",
+			Env:      "",
+			Argument: "remediate-after",
+			Default:  3,
+			Usage:    "Consecutive CRITICAL runs before --remediate restarts a service",
+			Value:    &plugin.RemediateAfter,
+		},
+		{
+			Path:     "handler-action",
+			Env:      "",
+			Argument: "handler-action",
+			Default:  "restart",
+			Usage:    "Action taken in --mode handler, one of restart or unload, overridden by the handler-action annotation",
+			Value:    &plugin.HandlerAction,
+		},
+		{
+			Path:     "ctl-secret-file",
+			Env:      "",
+			Argument: "ctl-secret-file",
+			Default:  "",
+			Usage:    "File holding the control gateway secret --remediate and --mode handler pass to hab svc, defaults to sup/default/CTL_SECRET under --hab-root, HAB_CTL_SECRET takes precedence",
+			Value:    &plugin.CtlSecretFile,
+		},
+		{
+			Path:     "output-format",
+			Env:      "",
+			Argument: "output-format",
+			Default:  "text",
+			Usage:    "Check output format, one of text (compact, for Sensu), table (aligned, for interactive use), csv, junit or checkmk (local check)",
+			Value:    &plugin.OutputFormat,
+		},
+		{
+			Path:     "line-format",
+			Env:      "",
+			Argument: "line-format",
+			Default:  "",
+			Usage:    "Format of each service line of the text output, with the placeholders {service}, {status}, {ident} and {error}",
+			Value:    &plugin.LineFormat,
+		},
+		{
+			Path:     "output-file",
+			Env:      "",
+			Argument: "output-file",
+			Default:  "",
+			Usage:    "Also append the check output of every run to this file, byte for byte as printed, so the last result can be read on the host",
+			Value:    &plugin.OutputFile,
+		},
+		{
+			Path:     "output-file-max-size",
+			Env:      "",
+			Argument: "output-file-max-size",
+			Default:  1024,
+			Usage:    "Size in KB at which --output-file is rotated to a single .1 backup (0 disables rotation)",
+			Value:    &plugin.OutputFileMaxSize,
+		},
+		{
+			Path:     "output-file-header",
+			Env:      "",
+			Argument: "output-file-header",
+			Default:  false,
+			Usage:    "Precede every run in --output-file with a \"# <time> <status>\" line and end it with a newline",
+			Value:    &plugin.OutputFileHeader,
+		},
+		{
+			Path:     "label",
+			Env:      "",
+			Argument: "label",
+			Default:  []string{},
+			Usage:    "Label attached to the metrics, JSON output and generated events, in format key=value, repeat for several",
+			Value:    &plugin.Labels,
+		},
+		{
+			Path:     "metrics-format",
+			Env:      "",
+			Argument: "metrics-format",
+			Default:  "",
+			Usage:    "Print metrics instead of the check output, one of \"prometheus\" or \"opentsdb\" (empty disables)",
+			Value:    &plugin.MetricsFormat,
+		},
+		{
+			Path:     "ring-metrics",
+			Env:      "",
+			Argument: "ring-metrics",
+			Default:  false,
+			Usage:    "Emit the number of ring members by state, fetching the census on every run, requires --metrics-format",
+			Value:    &plugin.RingMetrics,
+		},
+		{
+			Path:     "expected-members",
+			Env:      "",
+			Argument: "expected-members",
+			Default:  []string{},
+			Usage:    "Exact number of alive census members expected for a service group, in format service_name.service_group=N",
+			Value:    &plugin.ExpectedMembers,
+		},
+		{
+			Path:     "suspect-warn",
+			Env:      "",
+			Argument: "suspect-warn",
+			Default:  0,
+			Usage:    "Warn when at least this many census members are suspect (0 disables)",
+			Value:    &plugin.SuspectWarn,
+		},
+		{
+			Path:     "suspect-crit",
+			Env:      "",
+			Argument: "suspect-crit",
+			Default:  0,
+			Usage:    "Go critical when at least this many census members are suspect (0 disables)",
+			Value:    &plugin.SuspectCrit,
+		},
+		{
+			Path:     "check-update-leader",
+			Env:      "",
+			Argument: "check-update-leader",
+			Default:  false,
+			Usage:    "Verify loaded services using the rolling update strategy have an update leader and a finished update election",
+			Value:    &plugin.UpdateLeader,
+		},
+		{
+			Path:     "election-grace",
+			Env:      "",
+			Argument: "election-grace",
+			Default:  "",
+			Usage:    "Report a service group election or update election as CRITICAL once it has been unfinished for longer than this duration (e.g. 5m), requires --state-file",
+			Value:    &plugin.ElectionGrace,
+		},
+		{
+			Path:     "group-check",
+			Env:      "",
+			Argument: "group-check",
+			Default:  []string{},
+			Usage:    "Minimum percentage of a service group's census members that must report OK, in format service_name.service_group=N%",
+			Value:    &plugin.GroupChecks,
+		},
+		{
+			Path:     "version-tolerance",
+			Env:      "",
+			Argument: "version-tolerance",
+			Default:  -1,
+			Usage:    "In aggregate and peers mode, warn when supervisor patch versions across the ring differ by more than this (-1 disables, differing major.minor always warns)",
+			Value:    &plugin.VersionTolerance,
+		},
+		{
+			Path:     "partition-check",
+			Env:      "",
+			Argument: "partition-check",
+			Default:  0,
+			Usage:    "In aggregate mode, compare the alive members seen by up to this many members' census with the local one, CRITICAL on a network partition (0 disables)",
+			Value:    &plugin.PartitionCheck,
+		},
+		{
+			Path:     "partition-tolerance",
+			Env:      "",
+			Argument: "partition-tolerance",
+			Default:  10,
+			Usage:    "Percentage of members two census views may disagree on before --partition-check reports a partition",
+			Value:    &plugin.PartitionTolerance,
+		},
+		{
+			Path:     "member-id",
+			Env:      "",
+			Argument: "member-id",
+			Default:  "",
+			Usage:    "Narrow aggregate mode and the suspect and group census checks to this ring member",
+			Value:    &plugin.MemberID,
+		},
+		{
+			Path:     "zabbix-server",
+			Env:      "",
+			Argument: "zabbix-server",
+			Default:  "",
+			Usage:    "Zabbix server or proxy (host[:port]) to push per service health values to with the sender protocol",
+			Value:    &plugin.ZabbixServer,
+		},
+		{
+			Path:     "zabbix-host",
+			Env:      "",
+			Argument: "zabbix-host",
+			Default:  "",
+			Usage:    "Host name the values are sent for in Zabbix, defaults to the local hostname",
+			Value:    &plugin.ZabbixHost,
+		},
+		{
+			Path:     "webhook-url",
+			Env:      "",
+			Argument: "webhook-url",
+			Default:  "",
+			Usage:    "URL to POST the JSON run report to after the check completes",
+			Value:    &plugin.WebhookURL,
+		},
+		{
+			Path:     "webhook-secret",
+			Env:      "HABITAT_WEBHOOK_SECRET",
+			Argument: "webhook-secret",
+			Default:  "",
+			Usage:    "Secret used to sign the webhook body, sent as an HMAC-SHA256 in the X-Signature header",
+			Value:    &plugin.WebhookSecret,
+			Secret:   true,
+		},
+		{
+			Path:     "ship-url",
+			Env:      "",
+			Argument: "ship-url",
+			Default:  "",
+			Usage:    "Elasticsearch index (http://host:9200/index/_doc) or Logstash HTTP input URL to ship the JSON run report to",
+			Value:    &plugin.ShipURL,
+		},
+		{
+			Path:     "cloudwatch-namespace",
+			Env:      "",
+			Argument: "cloudwatch-namespace",
+			Default:  "",
+			Usage:    "Publish service health and status counts to this CloudWatch namespace (empty disables)",
+			Value:    &plugin.CloudWatchNamespace,
+		},
+		{
+			Path:     "cloudwatch-region",
+			Env:      "",
+			Argument: "cloudwatch-region",
+			Default:  "",
+			Usage:    "AWS region to publish to, defaults to AWS_REGION or the region of the EC2 instance",
+			Value:    &plugin.CloudWatchRegion,
+		},
+		{
+			Path:     "cloudwatch-dimension",
+			Env:      "",
+			Argument: "cloudwatch-dimension",
+			Default:  []string{},
+			Usage:    "Extra dimension added to every published metric, in format name=value",
+			Value:    &plugin.CloudWatchDimensions,
+		},
+		{
+			Path:     "sensu-api-url",
+			Env:      "",
+			Argument: "sensu-api-url",
+			Default:  "",
+			Usage:    "Sensu backend API URL to export the loaded services to as entity labels (habitat_<service>_<group>_version, habitat_services)",
+			Value:    &plugin.SensuAPIURL,
+		},
+		{
+			Path:     "sensu-api-key",
+			Env:      "SENSU_API_KEY",
+			Argument: "sensu-api-key",
+			Default:  "",
+			Usage:    "API key used with --sensu-api-url",
+			Value:    &plugin.SensuAPIKey,
+			Secret:   true,
+		},
+		{
+			Path:     "sensu-namespace",
+			Env:      "SENSU_NAMESPACE",
+			Argument: "sensu-namespace",
+			Default:  "default",
+			Usage:    "Namespace of the entity labeled with --sensu-api-url",
+			Value:    &plugin.SensuNamespace,
+		},
+		{
+			Path:     "sensu-entity",
+			Env:      "",
+			Argument: "sensu-entity",
+			Default:  "",
+			Usage:    "Entity labeled with --sensu-api-url, defaults to the hostname",
+			Value:    &plugin.SensuEntity,
+		},
+		{
+			Path:     "auth-token",
+			Env:      "HAB_SUP_GATEWAY_AUTH_TOKEN",
+			Argument: "auth-token",
+			Default:  "",
+			Usage:    "Bearer token for supervisors started with HAB_SUP_GATEWAY_AUTH_TOKEN",
+			Value:    &plugin.AuthToken,
+			Secret:   true,
+		},
+		{
+			Path:     "empty-services-severity",
+			Env:      "",
+			Argument: "empty-services-severity",
+			Default:  "ok",
+			Usage:    "Severity when the supervisor has no services loaded, one of ok, warning, critical or unknown",
+			Value:    &plugin.EmptyServicesSeverity,
+		},
+		{
+			Path:     "auth-severity",
+			Env:      "",
+			Argument: "auth-severity",
+			Default:  "critical",
+			Usage:    "Severity when the gateway rejects the request with 401 or 403, one of ok, warning, critical or unknown",
+			Value:    &plugin.AuthSeverity,
+		},
+		{
+			Path:     "config-error-severity",
+			Env:      "",
+			Argument: "config-error-severity",
+			Default:  "unknown",
+			Usage:    "Severity when the check is misconfigured (malformed or conflicting flags), one of ok, warning, critical or unknown",
+			Value:    &plugin.ConfigErrorSeverity,
+		},
+		{
+			Path:     "decode-error-severity",
+			Env:      "",
+			Argument: "decode-error-severity",
+			Default:  "unknown",
+			Usage:    "Severity when a gateway response cannot be decoded, such as from an unsupported supervisor version, one of ok, warning, critical or unknown",
+			Value:    &plugin.DecodeErrorSeverity,
+		},
+		{
+			Path:     "expect-status",
+			Env:      "",
+			Argument: "expect-status",
+			Default:  []string{},
+			Usage:    "Service intentionally stopped on this host, in format service_name.service_group=down, it is OK while not loaded or stopped and WARNING otherwise",
+			Value:    &plugin.ExpectStatus,
+		},
+		{
+			Path:     "warning-as",
+			Env:      "",
+			Argument: "warning-as",
+			Default:  "warning",
+			Usage:    "Severity of services whose health check reports WARNING, one of ok or warning, for health hooks using warning as an informational state",
+			Value:    &plugin.WarningAs,
+		},
+		{
+			Path:     "error-budget",
+			Env:      "",
+			Argument: "error-budget",
+			Default:  0,
+			Usage:    "Number of per service transport errors per run reported as WARNING, more than this are CRITICAL",
+			Value:    &plugin.ErrorBudget,
+		},
+		{
+			Path:     "weight",
+			Env:      "",
+			Argument: "weight",
+			Default:  []string{},
+			Usage:    "Weight of a service in the health score, in format service_name.service_group=N, services default to 1",
+			Value:    &plugin.Weights,
+		},
+		{
+			Path:     "score-warn",
+			Env:      "",
+			Argument: "score-warn",
+			Default:  0,
+			Usage:    "Warn when the health score reaches this, a WARNING service adds its weight and a CRITICAL one twice its weight, replacing the per service status",
+			Value:    &plugin.ScoreWarn,
+		},
+		{
+			Path:     "score-crit",
+			Env:      "",
+			Argument: "score-crit",
+			Default:  0,
+			Usage:    "Critical when the health score reaches this",
+			Value:    &plugin.ScoreCrit,
+		},
+		{
+			Path:     "client-p12",
+			Env:      "",
+			Argument: "client-p12",
+			Default:  "",
+			Usage:    "PKCS#12 bundle containing the client certificate and key to present to the supervisor",
+			Value:    &plugin.ClientP12,
+		},
+		{
+			Path:     "p12-password",
+			Env:      "HABITAT_P12_PASSWORD",
+			Argument: "p12-password",
+			Default:  "",
+			Usage:    "Password for the --client-p12 bundle",
+			Value:    &plugin.P12Password,
+			Secret:   true,
+		},
+	}
+
+	// lockWait holds the parsed --lock-wait duration.
+	lockWait time.Duration
+
+	// electionGrace holds the parsed --election-grace duration.
+	electionGrace time.Duration
+
+	// preflightTimeout holds the parsed --preflight-timeout duration.
+	preflightTimeout time.Duration
+
+	// escalateAfter holds the parsed --escalate-after duration.
+	escalateAfter time.Duration
+
+	// flapWindow holds the parsed --flap-window duration.
+	flapWindow time.Duration
+
+	// expectedStatus holds the parsed --expect-status values.
+	expectedStatus map[string]string
+
+	// out receives the human readable check output, it is discarded when
+	// metrics are printed instead
+	out io.Writer = os.Stdout
+)
+
+func main() {
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, runCheck, false)
+	check.Execute()
+}
+
+func checkArgs(event *types.Event) (int, error) {
+	severity, err := parseSeverity(plugin.ConfigErrorSeverity)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("--config-error-severity %v", err)
+	}
+
+	// configuration errors are not service problems, keep them apart from
+	// WARNING and CRITICAL unless told otherwise
+	if err := validateArgs(); err != nil {
+		return severity, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// validateArgs checks the flags and parses the ones that need it.
+func validateArgs() error {
+	switch plugin.Mode {
+	case "check", "aggregate", "peers", "inventory", "handler":
+	default:
+		return fmt.Errorf("--mode %q invalid, must be \"check\", \"aggregate\", \"peers\", \"inventory\" or \"handler\"", plugin.Mode)
+	}
+
+	if plugin.Mode == "handler" && plugin.SSH != "" {
+		return fmt.Errorf("--mode handler cannot be combined with --ssh")
+	}
+
+	if plugin.Mode == "handler" && (plugin.ServicesLabel != "" || plugin.ServicesSubPrefix != "" || plugin.EntityOverrides) {
+		return fmt.Errorf("--mode handler reads the event itself and cannot be combined with options reading it in check mode")
+	}
+
+	if plugin.Mode == "peers" && len(plugin.Peers) == 0 && plugin.PeerWatchFile == "" {
+		return fmt.Errorf("--mode peers requires at least one --peer or --peer-watch-file")
+	}
+
+	if !contains(outputFormats, plugin.OutputFormat) {
+		return fmt.Errorf("--output-format %q invalid, must be one of %s", plugin.OutputFormat, strings.Join(outputFormats, ", "))
+	}
+
+	if plugin.OutputFileMaxSize < 0 {
+		return fmt.Errorf("--output-file-max-size must not be negative")
+	}
+
+	for _, p := range linePlaceholder.FindAllString(plugin.LineFormat, -1) {
+		if !contains(linePlaceholders, p) {
+			return fmt.Errorf("--line-format placeholder %s invalid, must be one of %s", p, strings.Join(linePlaceholders, ", "))
+		}
+	}
+
+	switch plugin.MetricsFormat {
+	case "", "prometheus", "opentsdb":
+	default:
+		return fmt.Errorf("--metrics-format %q invalid, must be \"prometheus\" or \"opentsdb\"", plugin.MetricsFormat)
+	}
+
+	if plugin.RingMetrics && plugin.MetricsFormat == "" {
+		return fmt.Errorf("--ring-metrics requires --metrics-format")
+	}
+
+	if _, err := parseSeverity(plugin.NotRunningSeverity); err != nil {
+		return fmt.Errorf("--not-running-severity %v", err)
+	}
+
+	if _, err := parseSeverity(plugin.AuthSeverity); err != nil {
+		return fmt.Errorf("--auth-severity %v", err)
+	}
+
+	if _, err := parseSeverity(plugin.EmptyServicesSeverity); err != nil {
+		return fmt.Errorf("--empty-services-severity %v", err)
+	}
+
+	if _, err := parseSeverity(plugin.DecodeErrorSeverity); err != nil {
+		return fmt.Errorf("--decode-error-severity %v", err)
+	}
+
+	plugin.Services = splitList(plugin.Services)
+	plugin.ForbidChannel = splitList(plugin.ForbidChannel)
+	fromEntity := plugin.ServicesLabel != "" || plugin.ServicesSubPrefix != ""
+	if contains(plugin.Services, "-") {
+		if fromEntity || plugin.EntityOverrides || plugin.Mode == "handler" {
+			return fmt.Errorf("--service - cannot be combined with options reading the event from stdin")
+		}
+		services, err := expandStdin(plugin.Services, os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read --service list from stdin: %v", err)
+		}
+		if len(services) == 0 {
+			// checking every service instead would hide a broken pipeline
+			return fmt.Errorf("--service - read no services from stdin")
+		}
+		plugin.Services = services
+	}
+
+	var event *types.Event
+	var err error
+	if fromEntity || plugin.EntityOverrides {
+		event, err = readStdinEvent(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fromEntity {
+		services := entityServices(event.Entity, plugin.ServicesLabel, plugin.ServicesSubPrefix)
+		if len(services) == 0 {
+			return fmt.Errorf("entity %s has no services in label %q or subscriptions prefixed %q", event.Entity.Name, plugin.ServicesLabel, plugin.ServicesSubPrefix)
+		}
+		plugin.Services = append(plugin.Services, services...)
+	}
+
+	if len(plugin.Services) > 0 {
+		for _, service := range plugin.Services {
+			if _, err := parseServiceGroup(service); err != nil {
+				return fmt.Errorf("--service %q value malformed should be \"[application.environment#]service_name.service_group[@organization]\"", service)
+			}
+		}
+	}
+
+	assignments, err := parseAssignments("--expected-members", "service_name.service_group=N", plugin.ExpectedMembers)
+	if err != nil {
+		return err
+	}
+	expectedMembers = make(map[string]int, len(assignments))
+	for group, value := range assignments {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("--expected-members %q count must be a non-negative integer", group+"="+value)
+		}
+		expectedMembers[group] = n
+	}
+
+	assignments, err = parseAssignments("--group-check", "service_name.service_group=N%", plugin.GroupChecks)
+	if err != nil {
+		return err
+	}
+	groupChecks = make(map[string]int, len(assignments))
+	for group, value := range assignments {
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("--group-check %q percentage must be between 0 and 100", group+"="+value)
+		}
+		groupChecks[group] = n
+	}
+
+	assignments, err = parseAssignments("--weight", "service_name.service_group=N", plugin.Weights)
+	if err != nil {
+		return err
+	}
+	serviceWeights = make(map[string]int, len(assignments))
+	for group, value := range assignments {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("--weight %q must be a non-negative integer", group+"="+value)
+		}
+		serviceWeights[group] = n
+	}
+
+	if plugin.ScoreWarn < 0 || plugin.ScoreCrit < 0 {
+		return fmt.Errorf("--score-warn and --score-crit must not be negative")
+	}
+	if plugin.ScoreWarn > 0 && plugin.ScoreCrit > 0 && plugin.ScoreWarn > plugin.ScoreCrit {
+		return fmt.Errorf("--score-warn %d is above --score-crit %d", plugin.ScoreWarn, plugin.ScoreCrit)
+	}
+
+	switch plugin.WarningAs {
+	case "ok", "warning":
+	default:
+		return fmt.Errorf("--warning-as %q invalid, must be \"ok\" or \"warning\"", plugin.WarningAs)
+	}
+
+	expectedStatus, err = parseAssignments("--expect-status", "service_name.service_group=down", plugin.ExpectStatus)
+	if err != nil {
+		return err
+	}
+	for group, status := range expectedStatus {
+		if status != "down" {
+			return fmt.Errorf("--expect-status %q status must be \"down\"", group+"="+status)
+		}
+	}
+
+	if plugin.EntityOverrides {
+		if err := applyEntityOverrides(event.Entity.Annotations); err != nil {
+			return err
+		}
+	}
+
+	if plugin.HabDiskWarn < 0 || plugin.HabDiskWarn > 100 || plugin.HabDiskCrit < 0 || plugin.HabDiskCrit > 100 {
+		return fmt.Errorf("--hab-disk-warn and --hab-disk-crit must be percentages between 0 and 100")
+	}
+
+	if plugin.SupRSSWarn < 0 || plugin.SupRSSCrit < 0 || plugin.SupFDsWarn < 0 || plugin.SupFDsCrit < 0 || plugin.SupThreadsWarn < 0 || plugin.SupThreadsCrit < 0 {
+		return fmt.Errorf("--sup-rss, --sup-fds and --sup-threads thresholds must not be negative")
+	}
+
+	if plugin.SuspectWarn < 0 || plugin.SuspectCrit < 0 {
+		return fmt.Errorf("--suspect-warn and --suspect-crit must not be negative")
+	}
+
+	if plugin.P12Password != "" && plugin.ClientP12 == "" {
+		return fmt.Errorf("--p12-password requires --client-p12")
+	}
+
+	extraLabels, err = parseAssignments("--label", "key=value", plugin.Labels)
+	if err != nil {
+		return err
+	}
+
+	cloudWatchDimensions, err = parseAssignments("--cloudwatch-dimension", "name=value", plugin.CloudWatchDimensions)
+	if err != nil {
+		return err
+	}
+
+	lockWait, err = time.ParseDuration(plugin.LockWait)
+	if err != nil || lockWait < 0 {
+		return fmt.Errorf("--lock-wait %q must be a duration", plugin.LockWait)
+	}
+
+	preflightTimeout, err = time.ParseDuration(plugin.PreflightTimeout)
+	if err != nil || preflightTimeout < 0 {
+		return fmt.Errorf("--preflight-timeout %q must be a duration", plugin.PreflightTimeout)
+	}
+
+	if plugin.EscalateAfter != "" {
+		escalateAfter, err = time.ParseDuration(plugin.EscalateAfter)
+		if err != nil || escalateAfter <= 0 {
+			return fmt.Errorf("--escalate-after %q must be a positive duration", plugin.EscalateAfter)
+		}
+		if plugin.StateFile == "" {
+			return fmt.Errorf("--escalate-after requires --state-file")
+		}
+	}
+
+	if plugin.ElectionGrace != "" {
+		electionGrace, err = time.ParseDuration(plugin.ElectionGrace)
+		if err != nil || electionGrace <= 0 {
+			return fmt.Errorf("--election-grace %q must be a positive duration", plugin.ElectionGrace)
+		}
+		if plugin.StateFile == "" {
+			return fmt.Errorf("--election-grace requires --state-file")
+		}
+	}
+
+	if plugin.LatencyWarn != "" {
+		latencyWarn, err = time.ParseDuration(plugin.LatencyWarn)
+		if err != nil || latencyWarn <= 0 {
+			return fmt.Errorf("--latency-warn %q must be a positive duration", plugin.LatencyWarn)
+		}
+	}
+
+	if plugin.LatencyCrit != "" {
+		latencyCrit, err = time.ParseDuration(plugin.LatencyCrit)
+		if err != nil || latencyCrit <= 0 {
+			return fmt.Errorf("--latency-crit %q must be a positive duration", plugin.LatencyCrit)
+		}
+	}
+
+	if plugin.BuilderLatency != "" {
+		builderLatency, err = time.ParseDuration(plugin.BuilderLatency)
+		if err != nil || builderLatency <= 0 {
+			return fmt.Errorf("--builder-latency %q must be a positive duration", plugin.BuilderLatency)
+		}
+	}
+
+	if plugin.PartitionCheck < 0 {
+		return fmt.Errorf("--partition-check must not be negative")
+	}
+	if plugin.PartitionTolerance < 0 || plugin.PartitionTolerance > 100 {
+		return fmt.Errorf("--partition-tolerance %d must be between 0 and 100", plugin.PartitionTolerance)
+	}
+
+	if plugin.ErrorBudget < 0 {
+		return fmt.Errorf("--error-budget must not be negative")
+	}
+
+	if plugin.MaxRedirects < 0 {
+		return fmt.Errorf("--max-redirects must not be negative")
+	}
+
+	if plugin.FlapThreshold < 0 {
+		return fmt.Errorf("--flap-threshold must not be negative")
+	}
+	if plugin.FlapThreshold > 0 {
+		flapWindow, err = time.ParseDuration(plugin.FlapWindow)
+		if err != nil || flapWindow <= 0 {
+			return fmt.Errorf("--flap-window %q must be a positive duration", plugin.FlapWindow)
+		}
+		if plugin.StateFile == "" {
+			return fmt.Errorf("--flap-threshold requires --state-file")
+		}
+	}
+
+	if plugin.Remediate {
+		if plugin.StateFile == "" {
+			return fmt.Errorf("--remediate requires --state-file")
+		}
+		if plugin.RemediateAfter < 1 {
+			return fmt.Errorf("--remediate-after must be at least 1")
+		}
+		// the tunnel only carries the HTTP gateway, not the control gateway
+		if plugin.SSH != "" {
+			return fmt.Errorf("--remediate cannot be combined with --ssh")
+		}
+	}
+
+	if plugin.DetectUnloaded && plugin.StateFile == "" {
+		return fmt.Errorf("--detect-unloaded requires --state-file")
+	}
+
+	if plugin.DetectRestart && plugin.StateFile == "" {
+		return fmt.Errorf("--detect-restart requires --state-file")
+	}
+
+	if plugin.SensuAPIURL != "" && plugin.SensuAPIKey == "" {
+		return fmt.Errorf("--sensu-api-url requires --sensu-api-key")
+	}
+
+	if plugin.WebhookSecret != "" && plugin.WebhookURL == "" {
+		return fmt.Errorf("--webhook-secret requires --webhook-url")
+	}
+
+	if plugin.K8sGatewayPort < 1 || plugin.K8sGatewayPort > 65535 {
+		return fmt.Errorf("--k8s-gateway-port %d invalid, must be between 1 and 65535", plugin.K8sGatewayPort)
+	}
+
+	rollupStrategy, err = parseAggregateStrategy(plugin.Aggregate)
+	if err != nil {
+		return fmt.Errorf("--aggregate %v", err)
+	}
+
+	if plugin.UnreachableTolerance < 0 {
+		return fmt.Errorf("--unreachable-tolerance must not be negative")
+	}
+
+	if plugin.MaxRPS < 0 {
+		return fmt.Errorf("--max-rps must not be negative")
+	} else if plugin.MaxRPS > 0 {
+		gatewayRate = &rateLimit{interval: time.Second / time.Duration(plugin.MaxRPS)}
+	}
+
+	if plugin.MaxSupervisors < 1 || plugin.RequestsPerSupervisor < 1 {
+		return fmt.Errorf("--max-supervisors and --requests-per-supervisor must be at least 1")
+	}
+
+	if plugin.EC2GatewayPort < 1 || plugin.EC2GatewayPort > 65535 {
+		return fmt.Errorf("--ec2-gateway-port %d invalid, must be between 1 and 65535", plugin.EC2GatewayPort)
+	}
+
+	ec2Filters, err = parseAssignments("--ec2-tag", "key=value", plugin.EC2Tags)
+	if err != nil {
+		return err
+	}
+	if plugin.DiscoverEC2 && len(ec2Filters) == 0 {
+		// without a tag every instance in the region would be checked
+		return fmt.Errorf("--discover-ec2 requires at least one --ec2-tag")
+	}
+
+	if discoveryEnabled() && plugin.Mode != "check" {
+		return fmt.Errorf("supervisor discovery is only supported in --mode check")
+	}
+
+	if plugin.SSH != "" && (discoveryEnabled() || len(plugin.ProbePorts) > 0) {
+		return fmt.Errorf("--ssh cannot be combined with supervisor discovery or --probe-ports")
+	}
+
+	if plugin.SupervisorEvents && !discoveryEnabled() {
+		return fmt.Errorf("--supervisor-events requires supervisor discovery")
+	}
+
+	// the event is not read, the check does not know its own name
+	if plugin.SupervisorEvents && plugin.EventCheckName == "" {
+		return fmt.Errorf("--supervisor-events requires --event-check-name")
+	}
+
+	// the scheme is detected once the run starts, parse as HTTPS meanwhile
+	if !strings.Contains(plugin.SupervisorURL, "://") {
+		schemeOmitted = true
+		plugin.SupervisorURL = "https://" + plugin.SupervisorURL
+	}
+
+	_, err = url.Parse(plugin.SupervisorURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse supervisor URL %s: %v", plugin.SupervisorURL, err)
+	}
+
+	probePorts, err = parsePorts("--probe-ports", plugin.ProbePorts)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitList expands comma separated flag values, so a list can be given in a
+// single occurrence where repeating the flag is awkward to template.
+func splitList(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+// expandStdin replaces a "-" in values with the lines read from r, blank lines
+// are skipped.
+func expandStdin(values []string, r io.Reader) ([]string, error) {
+	var result []string
+	for _, v := range values {
+		if v != "-" {
+			result = append(result, v)
+			continue
+		}
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				result = append(result, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// parseAssignments splits repeated "key=value" flag values into a map, format
+// describes the expected value in the error for malformed ones.
+func parseAssignments(flag string, format string, values []string) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+
+	for _, v := range values {
+		split := strings.SplitN(v, "=", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			return nil, fmt.Errorf("%s %q value malformed should be \"%s\"", flag, v, format)
+		}
+		result[split[0]] = split[1]
+	}
+
+	return result, nil
+}
+
+type ServiceResponse []ServiceDetail
+
+type ServiceDetail struct {
+	ServiceGroup   string         `json:"service_group"`
+	Channel        string         `json:"channel"`
+	Topology       string         `json:"topology"`
+	UpdateStrategy string         `json:"update_strategy"`
+	Pkg            ServicePkg     `json:"pkg"`
+	Process        ServiceProcess `json:"process"`
+	Sys            SysInfo        `json:"sys"`
+}
+
+func (r ServiceResponse) checkShape() error {
+	for _, s := range r {
+		if !strings.Contains(s.ServiceGroup, ".") {
+			return fmt.Errorf("has a service without a service_group")
+		}
+	}
+	return nil
+}
+
+type ServicePkg struct {
+	Ident string `json:"ident"`
+}
+
+type ServiceProcess struct {
+	PID          int    `json:"pid"`
+	State        string `json:"state"`
+	StateEntered int64  `json:"state_entered"`
+}
+
+// SysInfo describes the supervisor a service runs under, every service
+// carries the same copy.
+type SysInfo struct {
+	Version         string `json:"version"`
+	MemberID        string `json:"member_id"`
+	Hostname        string `json:"hostname"`
+	IP              string `json:"ip"`
+	GossipIP        string `json:"gossip_ip"`
+	GossipPort      int    `json:"gossip_port"`
+	HTTPGatewayIP   string `json:"http_gateway_ip"`
+	HTTPGatewayPort int    `json:"http_gateway_port"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+func (r HealthResponse) checkShape() error {
+	if r.Status == "" {
+		return fmt.Errorf("has no status")
+	}
+	return nil
+}
+
+type Health struct {
+	ServiceGroup string
+	Status       int
+	Error        error
+
+	// Reason explains a status that differs from what the supervisor reported
+	Reason string
+
+	// Checked is when the health call completed
+	Checked time.Time
+
+	// filled from the service details when an output needs them
+	Ident          string
+	ProcessState   string
+	StateEntered   time.Time
+	Channel        string
+	Topology       string
+	UpdateStrategy string
+}
+
+func (h Health) tags() map[string]string {
+	return serviceTags(h.ServiceGroup, h.Ident, h.Channel, h.Topology, h.UpdateStrategy)
 }
 
-var (
-	plugin = Config{
-		PluginConfig: sensu.PluginConfig{
-			Name:     "sensu-habitat-check",
-			Short:    "Checks habitat supervisor for service health",
-			Keyspace: "sensu.io/plugins/sensu-habitat-check/config",
-		},
+func executeCheck(event *types.Event) (int, error) {
+	if plugin.LockFile != "" {
+		release, err := acquireLock(plugin.LockFile, lockWait)
+		if err == errLocked {
+			// a slow supervisor is not a reason for the event to flap, the
+			// running check reports its state
+			fmt.Fprintln(out, "Skipped, previous run still in progress")
+			return sensu.CheckStateOK, nil
+		} else if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("failed to lock %s: %v", plugin.LockFile, err)
+		}
+		defer release()
+	}
+
+	if plugin.SSH != "" {
+		closeTunnel, err := openTunnel()
+		if err != nil {
+			return sensu.CheckStateCritical, err
+		}
+		defer closeTunnel()
+	}
+
+	client, releaseClient, err := newClient()
+	if err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	defer releaseClient()
+
+	// every mode leaves stdout to its one line summary under --quiet
+	if plugin.Quiet {
+		out = ioutil.Discard
+	}
+
+	if discoveryEnabled() {
+		if plugin.MetricsFormat != "" {
+			out = ioutil.Discard
+			defer printMetrics()
+		}
+		return executeFleet(client, plugin.EventCheckName)
+	}
+
+	// a handler acts on the supervisor of the event, usually from the
+	// backend where no supervisor listens
+	if plugin.Mode == "handler" {
+		return executeHandler(client)
+	}
+
+	if len(probePorts) > 0 {
+		if err := probeSupervisorPort(); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+
+	if schemeOmitted {
+		if err := detectScheme(); isConnRefused(err) {
+			return supervisorNotRunning()
+		} else if err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+
+	if preflightTimeout > 0 {
+		if err := preflight(preflightTimeout); err != nil {
+			if isConnRefused(err) {
+				return supervisorNotRunning()
+			}
+			return sensu.CheckStateCritical, fmt.Errorf("supervisor gateway %s did not accept a connection within %s: %v", getSupervisorUrl(), preflightTimeout, err)
+		}
+	}
+
+	if plugin.Mode == "aggregate" {
+		return executeAggregate(client)
+	}
+
+	if plugin.Mode == "peers" {
+		return executePeers(client)
+	}
+
+	if plugin.Mode == "inventory" {
+		return executeInventory(client)
+	}
+
+	if plugin.MetricsFormat != "" {
+		out = ioutil.Discard
+		defer printMetrics()
+	}
+
+	// fetched once, for the verbose output, metrics and the JSON reports
+	if plugin.Verbose || plugin.MetricsFormat != "" || plugin.SummaryJSON || plugin.WebhookURL != "" || plugin.ShipURL != "" {
+		sys, err := getSupervisorSys(getSupervisorUrl(), client)
+		runSupervisor = sys
+		if err != nil {
+			fmt.Fprintf(out, "Could not retrieve supervisor details: %v\n", err)
+		} else if sys != nil {
+			if plugin.Verbose {
+				fmt.Fprintln(out, sys)
+			}
+			addMetric("habitat_supervisor_info", 1, map[string]string{
+				"version":   sys.Version,
+				"member_id": sys.MemberID,
+				"hostname":  sys.Hostname,
+			})
+		}
+	}
+
+	var services = plugin.Services
+
+	if len(services) == 0 {
+		services, err = getAllServices(client)
+		if isConnRefused(err) {
+			return supervisorNotRunning()
+		} else if ae := asAuthError(err); ae != nil {
+			return authFailure(ae)
+		} else if de := asDecodeError(err); de != nil {
+			return decodeFailure(de)
+		} else if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("could not retrieve services: %v", err)
+		}
+
+		// a host expected to run services may have failed provisioning
+		if severity, _ := parseSeverity(plugin.EmptyServicesSeverity); len(services) == 0 && severity != sensu.CheckStateOK {
+			fmt.Fprintf(out, "No services loaded")
+			return severity, nil
+		}
+	}
+
+	health := checkServices(getSupervisorUrl(), services, client)
+
+	if len(health) > 0 && allConnRefused(health) {
+		return supervisorNotRunning()
+	}
+
+	if len(health) > 0 && allAuthErrors(health) {
+		return authFailure(asAuthError(health[0].Error))
+	}
+
+	applyExpectedStatus(health)
+	applyDecodeErrors(health)
+
+	var stateFindings []Finding
+	var remediateGroups []string
+	if plugin.StateFile != "" {
+		state, err := loadState(plugin.StateFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+
+		// only a discovered service list tells what is loaded
+		if plugin.DetectUnloaded && len(plugin.Services) == 0 {
+			for _, group := range unloadedServices(state, health) {
+				stateFindings = append(stateFindings, Finding{
+					ServiceGroup: group,
+					Status:       sensu.CheckStateWarning,
+					Message:      "unloaded since the last run",
+				})
+			}
+		}
+
+		applyState(state, health, time.Now())
+
+		if plugin.DetectRestart {
+			stateFindings = append(stateFindings, checkSupervisorRestart(state)...)
+		}
+
+		if plugin.Remediate {
+			remediateGroups = remediationDue(state)
+		}
+
+		if err := state.save(plugin.StateFile); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("failed to save state file %s: %v", plugin.StateFile, err)
+		}
+	}
+
+	applyErrorBudget(health)
+
+	var details ServiceResponse
+	var detailsErr error
+	if plugin.OutputFormat == "table" || plugin.OutputFormat == "csv" || needsUptime() || plugin.CheckInstalled || plugin.CheckOriginKeys || len(plugin.ForbidChannel) > 0 || strings.Contains(plugin.LineFormat, "{ident}") || len(remediateGroups) > 0 || plugin.SensuAPIURL != "" {
+		// the package and process columns come from the service details,
+		// a failure here only leaves them blank
+		details, detailsErr = getServiceDetails(getSupervisorUrl(), client)
+		if detailsErr == nil {
+			addServiceDetails(health, details)
+		}
+	}
+
+	applyOverrides(health, time.Now())
+
+	findings, err := checkCensus(client)
+	if de := asDecodeError(err); de != nil {
+		return decodeFailure(de)
+	} else if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not retrieve census: %v", err)
+	}
+
+	findings = append(findings, checkLatency()...)
+	findings = append(findings, stateFindings...)
+	findings = append(findings, remediate(remediateGroups, health)...)
+
+	if plugin.CheckInstalled {
+		findings = append(findings, checkInstalledPackages(health)...)
 	}
 
-	options = []*sensu.PluginConfigOption{
-		{
-			Path:      "supervisor-url",
-			Env:       "",
-			Argument:  "supervisor-url",
-			Shorthand: "u",
-			Default:   "http://127.0.0.1:9631",
-			Usage:     "Supervisor URL",
-			Value:     &plugin.SupervisorURL,
-		},
-		{
-			Path:      "service",
-			Env:       "",
-			Argument:  "service",
-			Shorthand: "s",
-			Default:   []string{},
-			Usage:     "Explicit service to check, in format service_name.service_group",
-			Value:     &plugin.Services,
-		},
-		{
-			Path:      "timeout",
-			Env:       "",
-			Argument:  "timeout",
-			Shorthand: "t",
-			Default:   15,
-			Usage:     "Request timeout in seconds",
-			Value:     &plugin.Timeout,
-		},
+	if plugin.CheckOriginKeys {
+		findings = append(findings, checkOriginKeys(health)...)
 	}
-)
 
-func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
-	check.Execute()
-}
+	if len(plugin.ForbidChannel) > 0 {
+		findings = append(findings, checkForbiddenChannels(health)...)
+	}
 
-func checkArgs(event *types.Event) (int, error) {
-	if len(plugin.Services) > 0 {
-		for _, service := range plugin.Services {
-			serviceSplit := strings.SplitN(service, ".", 2)
-			if len(serviceSplit) != 2 {
-				return sensu.CheckStateWarning, fmt.Errorf("--service %q value malformed should be \"service_name.service_group\"", service)
-			}
-		}
+	if plugin.HabDiskWarn > 0 || plugin.HabDiskCrit > 0 {
+		findings = append(findings, checkHabDisk()...)
 	}
 
-	_, err := url.Parse(plugin.SupervisorURL)
-	if err != nil {
-		return sensu.CheckStateWarning, fmt.Errorf("failed to parse supervisor URL %s: %v", plugin.SupervisorURL, err)
+	if plugin.MaxOldReleases >= 0 {
+		findings = append(findings, checkOldReleases(plugin.MaxOldReleases)...)
 	}
 
-	return sensu.CheckStateOK, nil
-}
+	if processChecksEnabled() {
+		findings = append(findings, checkSupervisorProcess()...)
+	}
 
-type ServiceResponse []struct {
-	ServiceGroup string `json:"service_group"`
-}
+	if plugin.SystemdUnit != "" {
+		findings = append(findings, checkSystemdUnit()...)
+	}
 
-type HealthResponse struct {
-	Status string `json:"status"`
-}
+	if plugin.ProbeBuilder {
+		findings = append(findings, probeBuilder()...)
+	}
 
-type Health struct {
-	ServiceGroup string
-	Status       int
-	Error        error
-}
+	if plugin.SecurityAudit {
+		findings = append(findings, auditGateway(client)...)
+	}
 
-func executeCheck(event *types.Event) (int, error) {
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
+	if plugin.CheckEventStream {
+		findings = append(findings, checkEventStream()...)
+	}
 
-	var err error
-	var services = plugin.Services
+	for _, h := range health {
+		addMetric("habitat_service_health", float64(h.Status), h.tags())
+	}
 
-	if len(services) == 0 {
-		services, err = getAllServices(client)
+	if scoringEnabled() {
+		addMetric("habitat_health_score", float64(healthScore(health)), nil)
+	}
+
+	status := overallStatus(health, findings)
+	runHealth, runFindings = health, findings
+
+	if plugin.WebhookURL != "" {
+		if err := postWebhook(client, buildReport(health, findings, status)); err != nil {
+			fmt.Fprintf(out, "Failed to post results to webhook: %v\n", err)
+		}
+	}
+
+	if plugin.ShipURL != "" {
+		if err := shipReport(client, buildReport(health, findings, status)); err != nil {
+			fmt.Fprintf(out, "Failed to ship run report: %v\n", err)
+		}
+	}
+
+	if plugin.CloudWatchNamespace != "" {
+		if err := publishCloudWatch(health); err != nil {
+			fmt.Fprintf(out, "Failed to publish metrics to CloudWatch: %v\n", err)
+		}
+	}
+
+	if plugin.ZabbixServer != "" {
+		if err := sendZabbix(health, status); err != nil {
+			fmt.Fprintf(out, "Failed to send results to Zabbix: %v\n", err)
+		}
+	}
+
+	if plugin.SensuAPIURL != "" {
+		err := detailsErr
+		if err == nil {
+			err = exportEntityLabels(entityLabels(details))
+		}
 		if err != nil {
-			return sensu.CheckStateCritical, fmt.Errorf("could not retrieve services: %v", err)
+			fmt.Fprintf(out, "Failed to export entity labels: %v\n", err)
 		}
 	}
 
-	health := checkServices(services, client)
+	if plugin.Quiet && plugin.MetricsFormat == "" {
+		printQuiet(status, summary(health, findings, status))
+		return status, nil
+	}
+
+	switch plugin.OutputFormat {
+	case "table":
+		printTable(health, findings)
+	case "csv":
+		printCSV(health, findings)
+	case "junit":
+		printJUnit(health, findings)
+	case "checkmk":
+		printCheckMK(health, findings)
+	default:
+		printText(health, findings, status)
+	}
+
+	return status, nil
+}
 
-	oks := 0
+// overallStatus rolls the per service health and ring findings up into the
+// check result, an unknown anywhere is treated as critical. Only services
+// left UNKNOWN by --decode-error-severity keep the check UNKNOWN, unless
+// something else is critical.
+func overallStatus(health []Health, findings []Finding) int {
 	warnings := 0
 	criticals := 0
 	unknowns := 0
-	found := false
+
+	// with scoring the services only count through their weighted score
+	if scoringEnabled() {
+		switch scoreStatus(healthScore(health)) {
+		case sensu.CheckStateWarning:
+			warnings++
+		case sensu.CheckStateCritical:
+			criticals++
+		}
+		health = nil
+	}
 
 	for _, h := range health {
-		found = true
 		switch h.Status {
-		case sensu.CheckStateOK:
-			oks++
 		case sensu.CheckStateWarning:
 			warnings++
-			fmt.Printf("%s WARNING\n", h.ServiceGroup)
+		case sensu.CheckStateUnknown:
+			if asDecodeError(h.Error) != nil {
+				unknowns++
+			} else {
+				criticals++
+			}
 		case sensu.CheckStateCritical:
 			criticals++
-			fmt.Printf("%s CRITICAL\n", h.ServiceGroup)
-		case sensu.CheckStateUnknown:
-			unknowns++
-			fmt.Printf("%s UNKNOWN\n", h.ServiceGroup)
 		}
+	}
 
-		if h.Error != nil {
-			fmt.Printf("Error occured while checking service:\n%v\n", h.Error)
+	for _, f := range findings {
+		switch f.Status {
+		case sensu.CheckStateWarning:
+			warnings++
+		case sensu.CheckStateCritical, sensu.CheckStateUnknown:
+			criticals++
 		}
 	}
 
-	if criticals > 0 || unknowns > 0 {
-		return sensu.CheckStateCritical, nil
+	if criticals > 0 {
+		return sensu.CheckStateCritical
+	} else if unknowns > 0 {
+		return sensu.CheckStateUnknown
 	} else if warnings > 0 {
-		return sensu.CheckStateWarning, nil
+		return sensu.CheckStateWarning
 	}
 
-	if found {
-		fmt.Printf("All health checks returning OK for loaded services")
+	return sensu.CheckStateOK
+}
+
+// supervisorNotRunning reports a supervisor that refused the connection,
+// telling apart a host without Habitat from one where the supervisor is down.
+func supervisorNotRunning() (int, error) {
+	status, _ := parseSeverity(plugin.NotRunningSeverity)
+
+	if _, err := os.Stat(filepath.Join(plugin.HabRoot, "sup")); os.IsNotExist(err) {
+		fmt.Fprintf(out, "Habitat supervisor not installed (no %s, connection refused on %s)", filepath.Join(plugin.HabRoot, "sup"), getSupervisorUrl())
 	} else {
-		fmt.Printf("No services loaded")
+		fmt.Fprintf(out, "Habitat supervisor not running (connection refused on %s)", getSupervisorUrl())
 	}
 
-	return sensu.CheckStateOK, nil
+	// an active unit means systemd and the gateway disagree
+	if plugin.SystemdUnit != "" {
+		if active, sub, err := unitState(plugin.SystemdUnit); err == nil {
+			fmt.Fprintf(out, ", systemd unit %s is %s (%s)", plugin.SystemdUnit, active, sub)
+		}
+	}
+
+	return status, nil
+}
+
+// authFailure reports a gateway that rejected our credentials with the
+// configured severity rather than as a failed service.
+func authFailure(ae *authError) (int, error) {
+	status, _ := parseSeverity(plugin.AuthSeverity)
+	fmt.Fprint(out, ae.Message+"\n"+ae.Error())
+	return status, nil
+}
+
+func asAuthError(err error) *authError {
+	var ae *authError
+	if errors.As(err, &ae) {
+		return ae
+	}
+	return nil
+}
+
+func allAuthErrors(health []Health) bool {
+	for _, h := range health {
+		if asAuthError(h.Error) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeFailure reports a gateway response the check could not make sense of
+// with the configured severity, so a parser mismatch does not page like a
+// failed service.
+func decodeFailure(de *decodeError) (int, error) {
+	status, _ := parseSeverity(plugin.DecodeErrorSeverity)
+	fmt.Fprint(out, de.Error())
+	return status, nil
+}
+
+func asDecodeError(err error) *decodeError {
+	var de *decodeError
+	if errors.As(err, &de) {
+		return de
+	}
+	return nil
+}
+
+// applyDecodeErrors reports services whose health response could not be
+// decoded with --decode-error-severity.
+func applyDecodeErrors(health []Health) {
+	status, _ := parseSeverity(plugin.DecodeErrorSeverity)
+	for i, h := range health {
+		if asDecodeError(h.Error) != nil {
+			health[i].Status = status
+			health[i].Reason = "unexpected supervisor response"
+		}
+	}
+}
+
+// applyErrorBudget downgrades services whose health could not be fetched
+// because of a transport error to WARNING, as long as there are no more of
+// them than --error-budget allows.
+func applyErrorBudget(health []Health) {
+	if plugin.ErrorBudget == 0 {
+		return
+	}
+
+	var failed []int
+	for i, h := range health {
+		if isTransportError(h.Error) {
+			failed = append(failed, i)
+		}
+	}
+
+	if len(failed) == 0 || len(failed) > plugin.ErrorBudget {
+		return
+	}
+
+	for _, i := range failed {
+		health[i].Status = sensu.CheckStateWarning
+		health[i].Reason = fmt.Sprintf("transport error within budget, %d of %d", len(failed), plugin.ErrorBudget)
+	}
+}
+
+// applyExpectedStatus reports services expected to be down with
+// --expect-status as OK while the gateway does not find them, and as WARNING
+// when they turn out to be running.
+func applyExpectedStatus(health []Health) {
+	for i, h := range health {
+		if expectedStatus[h.ServiceGroup] != "down" {
+			continue
+		}
+
+		if isNotLoaded(h.Error) {
+			health[i].Status = sensu.CheckStateOK
+			health[i].Error = nil
+			health[i].Reason = "down as expected"
+		} else if h.Error == nil {
+			health[i].Status = sensu.CheckStateWarning
+			health[i].Reason = "running but expected to be down"
+		}
+	}
+}
+
+// isNotLoaded reports whether err is the gateway not finding a service,
+// because it is not loaded or has been stopped.
+func isNotLoaded(err error) bool {
+	var ge *gatewayError
+	return errors.As(err, &ge) && ge.StatusCode == http.StatusNotFound
+}
+
+// isTransportError reports whether err happened before the gateway produced
+// a response, such as a timeout or reset connection.
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ge *gatewayError
+	return !errors.As(err, &ge) && asAuthError(err) == nil && asDecodeError(err) == nil
+}
+
+func isConnRefused(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	// 10061 is WSAECONNREFUSED, which Windows reports instead
+	return errno == syscall.ECONNREFUSED || errno == 10061
+}
+
+func allConnRefused(health []Health) bool {
+	for _, h := range health {
+		if !isConnRefused(h.Error) {
+			return false
+		}
+	}
+	return true
+}
+
+// newClient builds the client for the gateway requests of a run, the
+// returned function releases what it holds once the run is over.
+func newClient() (*http.Client, func(), error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if plugin.ClientP12 != "" {
+		cert, err := loadClientP12(plugin.ClientP12, plugin.P12Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load client certificate %s: %v", plugin.ClientP12, err)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	var rt http.RoundTripper = transport
+	release := func() {}
+	if plugin.DebugRaw != "" {
+		w, closeDebug, err := openDebugRaw(plugin.DebugRaw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open --debug-raw %s: %v", plugin.DebugRaw, err)
+		}
+		rt = &debugTransport{next: transport, w: w}
+		release = closeDebug
+	}
+
+	return &http.Client{
+		Transport:     rt,
+		Timeout:       time.Duration(plugin.Timeout) * time.Second,
+		CheckRedirect: checkRedirect,
+	}, release, nil
+}
+
+// checkRedirect applies --follow-redirects and --max-redirects, followed
+// redirects are logged with --verbose so a proxy moving the gateway is visible.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	prev := via[len(via)-1].URL
+
+	if !plugin.FollowRedirects {
+		return fmt.Errorf("redirect from %s to %s not followed, --follow-redirects is disabled", prev, req.URL)
+	}
+
+	if len(via) > plugin.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", plugin.MaxRedirects)
+	}
+
+	if plugin.Verbose {
+		fmt.Fprintf(out, "Redirected from %s to %s\n", prev, req.URL)
+	}
+
+	return nil
+}
+
+func loadClientP12(path string, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return keyPairFromBlocks(blocks)
+}
+
+// keyPairFromBlocks pairs the private key of a PKCS#12 bundle with its
+// certificate. The bundle may carry CA certificates alongside the leaf in any
+// order, while X509KeyPair takes the first certificate for the leaf.
+func keyPairFromBlocks(blocks []*pem.Block) (tls.Certificate, error) {
+	var keyPEM []byte
+	var certs []*pem.Block
+	for _, b := range blocks {
+		if b.Type == "CERTIFICATE" {
+			certs = append(certs, b)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(b)...)
+		}
+	}
+
+	// the leaf is the certificate matching the private key, put it first
+	// with the rest of the chain after it
+	err := fmt.Errorf("no certificates in bundle")
+	for i := range certs {
+		certPEM := pem.EncodeToMemory(certs[i])
+		for j, c := range certs {
+			if j != i {
+				certPEM = append(certPEM, pem.EncodeToMemory(c)...)
+			}
+		}
+
+		var cert tls.Certificate
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		if err == nil {
+			return cert, nil
+		}
+	}
+
+	return tls.Certificate{}, err
 }
 
 func getAllServices(client *http.Client) ([]string, error) {
-	req, err := http.NewRequest("GET", getSupervisorUrl()+"/services", nil)
+	services, err := getServiceDetails(getSupervisorUrl(), client)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Accept", "application/json")
+	var result = make([]string, len(services))
+	for i, v := range services {
+		result[i] = v.ServiceGroup
+	}
+
+	return result, nil
+}
 
-	resp, err := client.Do(req)
+func getServiceDetails(baseURL string, client *http.Client) (ServiceResponse, error) {
+	resp, err := gatewayGet(client, baseURL+"/services")
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	var services ServiceResponse
-	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
-		return nil, fmt.Errorf("failed to decode service response: %v", err)
+	if err := checkStatus(resp); err != nil {
+		return nil, err
 	}
 
-	var result = make([]string, len(services))
-	for i, v := range services {
-		result[i] = v.ServiceGroup
+	var services ServiceResponse
+	if err := decodeJSON(resp, &services, "service"); err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return services, nil
 }
 
-func checkServices(services []string, client *http.Client) []Health {
-	var result []Health
+func checkServices(baseURL string, services []string, client *http.Client) []Health {
+	if len(services) == 0 {
+		return nil
+	}
+
+	result := make([]Health, len(services))
+
+	// limit the requests in flight so a gateway is not overwhelmed
+	limit := make(chan struct{}, atLeastOne(plugin.RequestsPerSupervisor))
+	var wg sync.WaitGroup
 
-	for _, service := range services {
-		health := checkService(service, client)
-		result = append(result, health)
+	for i, service := range services {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, service string) {
+			defer wg.Done()
+			health := checkService(baseURL, service, client)
+			health.Checked = time.Now().UTC()
+			result[i] = health
+			<-limit
+		}(i, service)
 	}
 
+	wg.Wait()
+
 	return result
 }
 
-func checkService(service string, client *http.Client) Health {
+// atLeastOne guards concurrency limits against options left unset.
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func checkService(baseURL string, service string, client *http.Client) Health {
 	var result Health
 	result.ServiceGroup = service
 	result.Status = sensu.CheckStateUnknown
 
-	serviceSplit := strings.SplitN(service, ".", 2)
-
-	req, err := http.NewRequest("GET", getSupervisorUrl()+"/services/"+serviceSplit[0]+"/"+serviceSplit[1]+"/health", nil)
+	sg, err := parseServiceGroup(service)
 	if err != nil {
 		result.Error = err
 		return result
 	}
 
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := client.Do(req)
+	resp, err := gatewayGet(client, baseURL+sg.gatewayPath()+"/health")
 	if err != nil {
 		result.Error = err
 		return result
@@ -221,24 +2427,112 @@ func checkService(service string, client *http.Client) Health {
 	// a service that isn't loaded or has been stopped returns a 404
 	if resp.StatusCode == 200 {
 		var hResp HealthResponse
-		if err := json.NewDecoder(resp.Body).Decode(&hResp); err != nil {
-			result.Error = fmt.Errorf("failed to decode health response: %v", err)
+		if err := decodeJSON(resp, &hResp, "health"); err != nil {
+			result.Error = err
 		} else {
 			if strings.EqualFold(hResp.Status, "ok") {
 				result.Status = sensu.CheckStateOK
 			} else if strings.EqualFold(hResp.Status, "warning") {
 				result.Status = sensu.CheckStateWarning
+				if plugin.WarningAs == "ok" {
+					result.Status = sensu.CheckStateOK
+					result.Reason = "health check reported WARNING, --warning-as ok"
+				}
 			} else if strings.EqualFold(hResp.Status, "critical") {
 				result.Status = sensu.CheckStateCritical
 			} else if strings.EqualFold(hResp.Status, "unknown") {
 				result.Status = sensu.CheckStateUnknown
 			}
 		}
+	} else if resp.StatusCode == http.StatusNotFound {
+		result.Error = newGatewayError(resp, "service not loaded or stopped", bodyExcerpt(resp.Body))
+	} else {
+		result.Error = checkStatus(resp)
 	}
 
 	return result
 }
 
+// getSupervisorSys returns the supervisor details carried by the loaded
+// services, or nil when nothing is loaded to read them from.
+func getSupervisorSys(baseURL string, client *http.Client) (*SysInfo, error) {
+	services, err := getServiceDetails(baseURL, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(services) == 0 {
+		return nil, nil
+	}
+
+	return &services[0].Sys, nil
+}
+
+func (s SysInfo) String() string {
+	return fmt.Sprintf("Supervisor %s (member %s, version %s, gossip %s:%d, http %s:%d)",
+		s.Hostname, s.MemberID, s.Version, s.GossipIP, s.GossipPort, s.HTTPGatewayIP, s.HTTPGatewayPort)
+}
+
+// addServiceDetails copies package and process information from the
+// supervisor's service details onto the matching health results.
+func addServiceDetails(health []Health, details ServiceResponse) {
+	byGroup := make(map[string]ServiceDetail, len(details))
+	for _, d := range details {
+		byGroup[d.ServiceGroup] = d
+	}
+
+	for i := range health {
+		d, ok := byGroup[health[i].ServiceGroup]
+		if !ok {
+			continue
+		}
+		health[i].Ident = d.Pkg.Ident
+		health[i].ProcessState = d.Process.State
+		health[i].Channel = d.Channel
+		health[i].Topology = d.Topology
+		health[i].UpdateStrategy = d.UpdateStrategy
+		if d.Process.StateEntered > 0 {
+			health[i].StateEntered = time.Unix(d.Process.StateEntered, 0)
+		}
+	}
+}
+
+func statusName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// parseSeverity converts a severity name used by the *-severity options into
+// a check state.
+func parseSeverity(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "ok":
+		return sensu.CheckStateOK, nil
+	case "warning":
+		return sensu.CheckStateWarning, nil
+	case "critical":
+		return sensu.CheckStateCritical, nil
+	case "unknown":
+		return sensu.CheckStateUnknown, nil
+	}
+	return 0, fmt.Errorf("%q invalid, must be one of ok, warning, critical or unknown", name)
+}
+
+func defaultHabRoot() string {
+	if runtime.GOOS == "windows" {
+		return `C:\hab`
+	}
+	return "/hab"
+}
+
 func getSupervisorUrl() string {
 	// a trailing slash will cause errors
 	return strings.TrimSuffix(plugin.SupervisorURL, "/")
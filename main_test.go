@@ -1,8 +1,1695 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestMain(t *testing.T) {
 }
+
+func TestMemberGatewayURL(t *testing.T) {
+	saved := plugin.SupervisorURL
+	plugin.SupervisorURL = "https://127.0.0.1:9631"
+	defer func() { plugin.SupervisorURL = saved }()
+
+	m := CensusMember{Sys: MemberSys{IP: "10.0.0.5", HTTPGatewayIP: "0.0.0.0", HTTPGatewayPort: 9631}}
+	if got := m.gatewayURL(); got != "https://10.0.0.5:9631" {
+		t.Errorf("unexpected gateway URL %q", got)
+	}
+
+	m.Sys.HTTPGatewayIP = "10.0.1.5"
+	if got := m.gatewayURL(); got != "https://10.0.1.5:9631" {
+		t.Errorf("unexpected gateway URL %q", got)
+	}
+}
+
+func TestMetricPointPrometheus(t *testing.T) {
+	m := metricPoint{
+		Name:  "habitat_supervisor_info",
+		Value: 1,
+		Tags:  map[string]string{"version": "1.6.56/20220701171503", "hostname": "sup-1"},
+	}
+
+	want := `habitat_supervisor_info{hostname="sup-1",version="1.6.56/20220701171503"} 1`
+	if got := m.prometheus(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMetricPointOpenTSDB(t *testing.T) {
+	m := metricPoint{
+		Name:  "habitat_service_health",
+		Value: 2,
+		Tags:  map[string]string{"service_group": "app.default@acme", "empty": ""},
+	}
+
+	want := `put habitat.service_health 1600000000 2 host=sup-1 service_group=app.default_acme`
+	if got := m.openTSDB(time.Unix(1600000000, 0), "sup-1"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestServiceTags(t *testing.T) {
+	h := Health{ServiceGroup: "app.default", Ident: "acme/app/1.0.0/20200101000000", Channel: "stable", Topology: "standalone"}
+
+	want := `habitat_service_health{channel="stable",origin="acme",service_group="app.default",topology="standalone"} 0`
+	if got := (metricPoint{Name: "habitat_service_health", Tags: h.tags()}).prometheus(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if tags := (Health{ServiceGroup: "app.default"}).tags(); len(tags) != 1 {
+		t.Errorf("expected only the service group without details, got %v", tags)
+	}
+}
+
+func TestParseServiceGroup(t *testing.T) {
+	cases := []struct {
+		in   string
+		path string
+	}{
+		{"redis.default", "/services/redis/default"},
+		{"redis.default@acme", "/services/redis/default/acme"},
+		{"myapp.prod#redis.default", "/services/redis/default"},
+		{"myapp.prod#redis.blue.green@acme", "/services/redis/blue.green/acme"},
+	}
+	for _, c := range cases {
+		sg, err := parseServiceGroup(c.in)
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if got := sg.gatewayPath(); got != c.path {
+			t.Errorf("%s: got %q, want %q", c.in, got, c.path)
+		}
+	}
+
+	for _, bad := range []string{"redis", "redis.", "myapp#redis.default", "redis.default@"} {
+		if _, err := parseServiceGroup(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestVersionDrift(t *testing.T) {
+	versions := map[string][]string{
+		"1.6.56/20220701171503": {"sup-1"},
+		"1.6.60/20220801171503": {"sup-2"},
+	}
+
+	if drift := versionDrift(versions, 4); drift != "" {
+		t.Errorf("unexpected drift within tolerance: %s", drift)
+	}
+	if drift := versionDrift(versions, 3); drift == "" {
+		t.Error("expected drift beyond tolerance")
+	}
+
+	versions["1.7.0/20230101000000"] = []string{"sup-3"}
+	if drift := versionDrift(versions, 100); drift == "" {
+		t.Error("expected drift across release lines")
+	}
+}
+
+func TestSignAWSv4(t *testing.T) {
+	// example request from the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds := &awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSv4(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyStateEscalation(t *testing.T) {
+	saved := escalateAfter
+	escalateAfter = 10 * time.Minute
+	defer func() { escalateAfter = saved }()
+
+	now := time.Now()
+	state := &State{Services: map[string]ServiceState{
+		"app.default": {Status: sensu.CheckStateWarning, Since: now.Add(-15 * time.Minute)},
+		"db.default":  {Status: sensu.CheckStateOK, Since: now.Add(-15 * time.Minute)},
+	}}
+	health := []Health{
+		{ServiceGroup: "app.default", Status: sensu.CheckStateWarning},
+		{ServiceGroup: "db.default", Status: sensu.CheckStateWarning},
+	}
+
+	applyState(state, health, now)
+
+	if health[0].Status != sensu.CheckStateCritical {
+		t.Errorf("expected app.default to be escalated, got %s", statusName(health[0].Status))
+	}
+	if health[1].Status != sensu.CheckStateWarning {
+		t.Errorf("expected db.default to stay WARNING, got %s", statusName(health[1].Status))
+	}
+	if state.Services["app.default"].Status != sensu.CheckStateWarning {
+		t.Error("expected the reported status to be persisted, not the escalated one")
+	}
+}
+
+func TestTrackElections(t *testing.T) {
+	saved := electionGrace
+	electionGrace = 5 * time.Minute
+	defer func() { electionGrace = saved }()
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"db.default":  {ElectionStatus: "ElectionInProgress"},
+		"app.default": {ElectionStatus: "ElectionFinished", UpdateElectionStatus: "None"},
+	}}
+	state := &State{}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if findings := trackElections(state, census, start); len(findings) != 0 {
+		t.Errorf("expected a new election to be within the grace, got %+v", findings)
+	}
+
+	findings := trackElections(state, census, start.Add(6*time.Minute))
+	if len(findings) != 1 || findings[0].ServiceGroup != "db.default" || findings[0].Status != sensu.CheckStateCritical {
+		t.Errorf("expected db.default to be stuck, got %+v", findings)
+	}
+
+	census.CensusGroups["db.default"] = CensusGroup{ElectionStatus: "ElectionFinished"}
+	trackElections(state, census, start.Add(7*time.Minute))
+	if len(state.Elections) != 0 {
+		t.Errorf("expected finished elections to be forgotten, got %v", state.Elections)
+	}
+}
+
+func TestDecodeJSONUnexpectedContentType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html><body>Bad Gateway</body></html>"))
+	}))
+	defer srv.Close()
+
+	resp, err := gatewayGet(srv.Client(), srv.URL+"/services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var v ServiceResponse
+	err = decodeJSON(resp, &v, "service")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{"GET " + srv.URL + "/services", "502 Bad Gateway", "text/html", "Bad Gateway</body>"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestDecodeJSONUnsupportedAPI(t *testing.T) {
+	cases := []struct {
+		body string
+		v    interface{}
+		want string
+	}{
+		{`[]`, &ServiceResponse{}, ""},
+		{`[{"service_group":"app.default","extra":1}]`, &ServiceResponse{}, ""},
+		{`{"services":[]}`, &ServiceResponse{}, "unsupported API"},
+		{`[{"name":"app"}]`, &ServiceResponse{}, "unsupported supervisor API"},
+		{`{"census_groups":{}}`, &CensusResponse{}, ""},
+		{`{"member_id":"abc"}`, &CensusResponse{}, "unsupported supervisor API"},
+		{`{"result":"ok"}`, &HealthResponse{}, "unsupported supervisor API"},
+	}
+
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(c.body))
+		}))
+
+		resp, err := gatewayGet(srv.Client(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = decodeJSON(resp, c.v, "test")
+		resp.Body.Close()
+		srv.Close()
+
+		if c.want == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", c.body, err)
+		}
+		if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.body, c.want, err)
+		}
+	}
+}
+
+func TestCensusDecodeStream(t *testing.T) {
+	payload := `{
+		"changed": false,
+		"census_groups": {
+			"app.default": {
+				"service_group": "app.default",
+				"update_election_status": "None",
+				"service_config": {"incarnation": 1, "value": {"port": [8080, 8081]}},
+				"population": {
+					"abc": {"member_id": "abc", "alive": true, "update_leader": true, "cfg": {"a": [1, {"b": null}]}, "sys": {"hostname": "one", "http_gateway_port": 9631}},
+					"def": {"member_id": "def", "suspect": true}
+				}
+			},
+			"db.default": {"service_group": "db.default", "population": null}
+		},
+		"last_election_counter": 3
+	}`
+
+	var want CensusResponse
+	if err := json.Unmarshal([]byte(payload), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	var got CensusResponse
+	if err := got.decodeStream(json.NewDecoder(strings.NewReader(payload))); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed census differs\n got %+v\nwant %+v", got, want)
+	}
+
+	var bad CensusResponse
+	err := bad.decodeStream(json.NewDecoder(strings.NewReader(`{"census_groups": []}`)))
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		t.Errorf("expected a type error for an array of groups, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limit := &rateLimit{interval: 10 * time.Millisecond}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limit.wait()
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected 5 requests to take at least 40ms, took %s", elapsed)
+	}
+}
+
+func TestDebugTransportRedactsToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer srv.Close()
+
+	var dump strings.Builder
+	client := &http.Client{Transport: &debugTransport{next: http.DefaultTransport, w: &dump}}
+
+	saved := plugin.AuthToken
+	plugin.AuthToken = "s3cr3t"
+	defer func() { plugin.AuthToken = saved }()
+
+	resp, err := gatewayGet(client, srv.URL+"/services/app/default/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var v HealthResponse
+	if err := decodeJSON(resp, &v, "health"); err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != "OK" {
+		t.Errorf("expected the body to still be readable, got status %q", v.Status)
+	}
+
+	if strings.Contains(dump.String(), "s3cr3t") {
+		t.Error("auth token written to the dump")
+	}
+	for _, want := range []string{"GET /services/app/default/health", "Authorization: REDACTED", `{"status":"OK"}`} {
+		if !strings.Contains(dump.String(), want) {
+			t.Errorf("dump does not contain %q", want)
+		}
+	}
+}
+
+func TestDebugTransportRedactsCredentialHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=c00k1e")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	var dump strings.Builder
+	client := &http.Client{Transport: &debugTransport{next: http.DefaultTransport, w: &dump}}
+
+	req, err := http.NewRequest("GET", srv.URL+"/v1/catalog/service/hab-sup", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Consul-Token", "c0nsul")
+	req.Header["x-vault-token"] = []string{"v4ult"}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, secret := range []string{"c0nsul", "v4ult", "c00k1e"} {
+		if strings.Contains(dump.String(), secret) {
+			t.Errorf("credential %q written to the dump", secret)
+		}
+	}
+	if req.Header.Get("X-Consul-Token") != "c0nsul" {
+		t.Error("expected the request itself to keep its token")
+	}
+}
+
+func TestEntityServices(t *testing.T) {
+	event, err := readStdinEvent(strings.NewReader(`{
+		"entity": {
+			"metadata": {"name": "web-1", "labels": {"habitat_services": "app.default; db.default"}},
+			"subscriptions": ["linux", "habitat:cache.default", "habitat:"]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := entityServices(event.Entity, "habitat_services", "habitat:")
+	want := []string{"app.default", "db.default", "cache.default"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	savedMembers, savedChecks, savedOverrides := expectedMembers, groupChecks, overrides
+	expectedMembers = map[string]int{}
+	groupChecks = map[string]int{}
+	defer func() { expectedMembers, groupChecks, overrides = savedMembers, savedChecks, savedOverrides }()
+	prefix := overridesPrefix()
+
+	err := applyEntityOverrides(map[string]string{
+		prefix + "postgres.default/min-uptime":       "300",
+		prefix + "cache.default/severity":            "warning",
+		prefix + "postgres.default/expected-members": "3",
+		"unrelated": "value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedMembers["postgres.default"] != 3 {
+		t.Errorf("expected the member count to be overridden, got %d", expectedMembers["postgres.default"])
+	}
+
+	now := time.Now()
+	health := []Health{
+		{ServiceGroup: "postgres.default", Status: sensu.CheckStateOK, StateEntered: now.Add(-time.Minute)},
+		{ServiceGroup: "cache.default", Status: sensu.CheckStateCritical},
+		{ServiceGroup: "app.default", Status: sensu.CheckStateCritical},
+	}
+	applyOverrides(health, now)
+
+	for i, want := range []int{sensu.CheckStateWarning, sensu.CheckStateWarning, sensu.CheckStateCritical} {
+		if health[i].Status != want {
+			t.Errorf("expected %s to be %s, got %s", health[i].ServiceGroup, statusName(want), statusName(health[i].Status))
+		}
+	}
+
+	if err := applyEntityOverrides(map[string]string{prefix + "app.default/bogus": "1"}); err == nil {
+		t.Error("expected an unknown setting to be rejected")
+	}
+}
+
+func TestCheckSupervisor(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/services":
+			w.Write([]byte(`[{"service_group":"app.default"},{"service_group":"db.default"}]`))
+		case "/services/app/default/health":
+			w.Write([]byte(`{"status":"OK"}`))
+		case "/services/db/default/health":
+			w.Write([]byte(`{"status":"CRITICAL"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	result := checkSupervisor(srv.URL, srv.Client())
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(result.Health) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(result.Health))
+	}
+	if result.Status != sensu.CheckStateCritical {
+		t.Errorf("expected CRITICAL, got %s", statusName(result.Status))
+	}
+
+	srv.Close()
+	result = checkSupervisor(srv.URL, srv.Client())
+	if result.Error == nil || result.Status != sensu.CheckStateCritical {
+		t.Errorf("expected an unreachable supervisor to be CRITICAL with an error, got %s", statusName(result.Status))
+	}
+}
+
+func TestAggregateStrategyRollup(t *testing.T) {
+	ok, warn, crit := sensu.CheckStateOK, sensu.CheckStateWarning, sensu.CheckStateCritical
+	statuses := []int{ok, ok, ok, crit, warn}
+
+	for strategy, want := range map[string]int{
+		"worst":       crit,
+		"majority":    ok,
+		"quorum":      warn,
+		"percent:60":  warn,
+		"percent:80":  crit,
+		"percent:100": crit,
+	} {
+		s, err := parseAggregateStrategy(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.rollup(statuses); got != want {
+			t.Errorf("%s: expected %s, got %s", strategy, statusName(want), statusName(got))
+		}
+	}
+
+	if _, err := parseAggregateStrategy("percent:101"); err == nil {
+		t.Error("expected percent:101 to be rejected")
+	}
+}
+
+func TestAggregateCensusZeroMembers(t *testing.T) {
+	savedServices, savedMembers, savedChecks := plugin.Services, expectedMembers, groupChecks
+	plugin.Services = []string{"app.default", "cache.default"}
+	expectedMembers, groupChecks = nil, nil
+	defer func() {
+		plugin.Services, expectedMembers, groupChecks = savedServices, savedMembers, savedChecks
+	}()
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"app.default": {Population: map[string]CensusMember{
+			"abc": {MemberID: "abc", Alive: false},
+		}},
+	}}
+
+	report := aggregateCensus(census, http.DefaultClient)
+
+	if report.Status != "CRITICAL" {
+		t.Errorf("expected CRITICAL, got %s", report.Status)
+	}
+	if len(report.ServiceGroups) != 2 {
+		t.Fatalf("expected 2 groups, got %+v", report.ServiceGroups)
+	}
+	for _, gr := range report.ServiceGroups {
+		if gr.Status != "CRITICAL" || gr.Message == "" {
+			t.Errorf("expected %s to be CRITICAL with a message, got %+v", gr.ServiceGroup, gr)
+		}
+	}
+}
+
+func TestAggregateCensusExpectedEmpty(t *testing.T) {
+	savedServices, savedMembers, savedChecks := plugin.Services, expectedMembers, groupChecks
+	plugin.Services = nil
+	expectedMembers, groupChecks = map[string]int{"canary.default": 0}, nil
+	defer func() {
+		plugin.Services, expectedMembers, groupChecks = savedServices, savedMembers, savedChecks
+	}()
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"canary.default": {Population: map[string]CensusMember{
+			"abc": {MemberID: "abc", Alive: false},
+		}},
+	}}
+
+	report := aggregateCensus(census, http.DefaultClient)
+
+	if report.Status != "OK" || len(report.ServiceGroups) != 1 || report.ServiceGroups[0].Status != "OK" {
+		t.Errorf("expected a group expected to be empty to be OK, got %+v", report)
+	}
+}
+
+func TestCheckExpectedMembersEmpty(t *testing.T) {
+	saved := expectedMembers
+	expectedMembers = map[string]int{"canary.default": 0, "app.default": 2}
+	defer func() { expectedMembers = saved }()
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"canary.default": {Population: map[string]CensusMember{}},
+	}}
+
+	findings := checkExpectedMembers(census)
+	if len(findings) != 1 || findings[0].ServiceGroup != "app.default" {
+		t.Errorf("expected only app.default to be reported, got %+v", findings)
+	}
+
+	if missing := missingGroups(census); len(missing) != 1 || missing[0] != "app.default" {
+		t.Errorf("expected only app.default to be missing, got %v", missing)
+	}
+}
+
+func TestUnreachableToleranceWithServices(t *testing.T) {
+	savedServices, savedTolerance := plugin.Services, plugin.UnreachableTolerance
+	plugin.Services = []string{"app.default"}
+	plugin.UnreachableTolerance = 1
+	defer func() {
+		plugin.Services, plugin.UnreachableTolerance = savedServices, savedTolerance
+	}()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	client := &http.Client{Timeout: time.Second}
+	results := []SupervisorResult{
+		checkSupervisor(up.URL, client),
+		checkSupervisor(downURL, client),
+	}
+	applyUnreachableTolerance(results)
+
+	if results[0].Status != sensu.CheckStateOK {
+		t.Errorf("expected the reachable supervisor to be OK, got %s", statusName(results[0].Status))
+	}
+	if results[1].Status != sensu.CheckStateWarning || results[1].Reason == "" {
+		t.Errorf("expected the unreachable supervisor to be tolerated, got %s %q", statusName(results[1].Status), results[1].Reason)
+	}
+}
+
+func TestRemoteSup(t *testing.T) {
+	cases := map[string]string{
+		"http://127.0.0.1:9631":      "",
+		"https://localhost:9631":     "",
+		"http://10.0.0.5:9631":       "10.0.0.5:9632",
+		"https://sup.example.com:80": "sup.example.com:9632",
+	}
+	for gatewayURL, want := range cases {
+		got, err := remoteSup(gatewayURL)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", gatewayURL, got, err, want)
+		}
+	}
+}
+
+func TestEventSupervisorURL(t *testing.T) {
+	annotated := map[string]string{plugin.Keyspace + "/supervisor-url": "http://10.0.0.5:9631/"}
+	if got, err := eventSupervisorURL(nil, annotated, "web-1"); err != nil || got != "http://10.0.0.5:9631" {
+		t.Errorf("expected the annotated supervisor, got %q, %v", got, err)
+	}
+
+	if _, err := eventSupervisorURL(nil, nil, "some-other-host.invalid"); err == nil {
+		t.Error("expected an event of another host without annotation to be refused")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := eventSupervisorURL(nil, nil, hostname); err != nil || got != getSupervisorUrl() {
+		t.Errorf("expected the local supervisor for an event of this host, got %q, %v", got, err)
+	}
+}
+
+func TestCtlSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctl-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "sup", "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sup", "default", "CTL_SECRET"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedRoot, savedEnv := plugin.HabRoot, os.Getenv("HAB_CTL_SECRET")
+	plugin.HabRoot = dir
+	os.Unsetenv("HAB_CTL_SECRET")
+	defer func() {
+		plugin.HabRoot = savedRoot
+		os.Setenv("HAB_CTL_SECRET", savedEnv)
+	}()
+
+	if secret, err := ctlSecret(); err != nil || secret != "s3cret" {
+		t.Errorf("expected the supervisor's secret file, got %q, %v", secret, err)
+	}
+
+	os.Setenv("HAB_CTL_SECRET", "from-env")
+	if secret, err := ctlSecret(); err != nil || secret != "from-env" {
+		t.Errorf("expected HAB_CTL_SECRET to take precedence, got %q, %v", secret, err)
+	}
+}
+
+func TestSendSupervisorEvents(t *testing.T) {
+	var names []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Check struct {
+				Metadata struct {
+					Name        string            `json:"name"`
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				ProxyEntityName string `json:"proxy_entity_name"`
+			} `json:"check"`
+		}
+		json.NewDecoder(r.Body).Decode(&event)
+		names = append(names, event.Check.Metadata.Name+"@"+event.Check.ProxyEntityName+"/"+event.Check.Metadata.Annotations["habitat_supervisor_member_id"])
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer agent.Close()
+
+	savedURL, savedName := plugin.AgentAPIURL, plugin.EventCheckName
+	plugin.AgentAPIURL = agent.URL
+	plugin.EventCheckName = "habitat-services"
+	defer func() { plugin.AgentAPIURL, plugin.EventCheckName = savedURL, savedName }()
+
+	results := []SupervisorResult{{URL: "http://10.0.0.5:9631", Hostname: "web-1", Sys: &SysInfo{MemberID: "abc123", Hostname: "web-1"}}}
+	if err := sendSupervisorEvents(results, plugin.EventCheckName); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 1 || names[0] != "habitat-services@web-1/abc123" {
+		t.Errorf("expected the event for habitat-services on web-1 annotated with its member, got %v", names)
+	}
+}
+
+func TestBuildReportSupervisor(t *testing.T) {
+	saved := runSupervisor
+	runSupervisor = &SysInfo{MemberID: "abc123", Hostname: "web-1", Version: "1.6.0/20200420"}
+	defer func() { runSupervisor = saved }()
+
+	data, err := json.Marshal(buildReport(nil, nil, sensu.CheckStateOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"supervisor":{"version":"1.6.0/20200420","member_id":"abc123","hostname":"web-1"`) {
+		t.Errorf("expected the supervisor details in the report, got %s", data)
+	}
+}
+
+func TestExecuteCheckSkipsOverlappingRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedLockFile, savedOut := plugin.LockFile, out
+	plugin.LockFile = filepath.Join(dir, "check.lock")
+	var buf bytes.Buffer
+	out = &buf
+	defer func() {
+		plugin.LockFile, out = savedLockFile, savedOut
+	}()
+
+	release, err := acquireLock(plugin.LockFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	status, err := executeCheck(nil)
+	if err != nil || status != sensu.CheckStateOK {
+		t.Errorf("expected an overlapping run to be OK, got %s, %v", statusName(status), err)
+	}
+	if buf.String() != "Skipped, previous run still in progress\n" {
+		t.Errorf("expected the skip to be written to the output, got %q", buf.String())
+	}
+}
+
+func TestKeyPairFromBlocksCAFirst(t *testing.T) {
+	newCert := func(cn string, key *rsa.PrivateKey, parent *x509.Certificate, parentKey *rsa.PrivateKey) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  parent == nil,
+			BasicConstraintsValid: true,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newCert("ca", caKey, nil, nil)
+	client := newCert("client", clientKey, ca, caKey)
+
+	// the order pkcs12.ToPEM returns for a bundle with the CA first
+	blocks := []*pem.Block{
+		{Type: "CERTIFICATE", Bytes: ca.Raw},
+		{Type: "CERTIFICATE", Bytes: client.Raw},
+		{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)},
+	}
+
+	cert, err := keyPairFromBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[0], client.Raw) {
+		t.Error("expected the client certificate first, followed by the CA")
+	}
+}
+
+func TestEntityLabelsPerGroup(t *testing.T) {
+	var details ServiceResponse
+	for _, d := range []struct{ group, ident string }{
+		{"app.default", "core/app/1.0.0/20210101000000"},
+		{"app.prod", "core/app/1.1.0/20210201000000"},
+	} {
+		var sd ServiceDetail
+		sd.ServiceGroup = d.group
+		sd.Pkg.Ident = d.ident
+		details = append(details, sd)
+	}
+
+	labels := entityLabels(details)
+	if labels["habitat_app_default_version"] != "1.0.0" || labels["habitat_app_prod_version"] != "1.1.0" {
+		t.Errorf("expected a version label per group, got %v", labels)
+	}
+}
+
+func TestExportEntityLabelsRemovesUnloaded(t *testing.T) {
+	var patch struct {
+		Metadata struct {
+			Labels map[string]*string `json:"labels"`
+		} `json:"metadata"`
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"metadata":{"name":"web-1","labels":{"habitat_old_version":"1.0.0","habitat_web_version":"1.0.0","region":"eu"}}}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+	}))
+	defer backend.Close()
+
+	savedURL, savedEntity := plugin.SensuAPIURL, plugin.SensuEntity
+	plugin.SensuAPIURL, plugin.SensuEntity = backend.URL, "web-1"
+	defer func() { plugin.SensuAPIURL, plugin.SensuEntity = savedURL, savedEntity }()
+
+	if err := exportEntityLabels(map[string]string{"habitat_web_version": "1.1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := patch.Metadata.Labels
+	if v, ok := labels["habitat_old_version"]; !ok || v != nil {
+		t.Errorf("expected the unloaded service's label to be removed, got %v", labels)
+	}
+	if v := labels["habitat_web_version"]; v == nil || *v != "1.1.0" {
+		t.Errorf("expected the loaded service's label to be updated, got %v", labels)
+	}
+	if _, ok := labels["region"]; ok {
+		t.Errorf("expected labels of others to be left alone, got %v", labels)
+	}
+}
+
+// failingWriter accepts n bytes and fails after, like a disk filling up.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, errors.New("no space left on device")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteRunReportsWriteErrors(t *testing.T) {
+	now := time.Date(2021, 4, 14, 12, 0, 0, 0, time.UTC)
+	if err := writeRun(&failingWriter{n: 10}, []byte("OK: 3 services healthy"), sensu.CheckStateOK, now); err == nil {
+		t.Error("expected a failed write of the output to be reported")
+	}
+	if err := writeRun(&failingWriter{n: 1024}, []byte("OK: 3 services healthy"), sensu.CheckStateOK, now); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestHandlerSkipsLocalPreflight(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer gateway.Close()
+
+	// nothing listens on the handler's own supervisor URL
+	local := httptest.NewServer(http.NotFoundHandler())
+	localURL := local.URL
+	local.Close()
+
+	event := fmt.Sprintf(`{"entity":{"metadata":{"name":"web-1"}},"check":{"status":2,"metadata":{"name":"habitat","annotations":{%q:"app.default",%q:%q}}}}`,
+		plugin.Keyspace+"/service-group", plugin.Keyspace+"/supervisor-url", gateway.URL)
+	stdin, err := ioutil.TempFile("", "event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	stdin.WriteString(event)
+	stdin.Seek(0, 0)
+
+	savedMode, savedURL, savedAction, savedPreflight, savedStdin, savedOut := plugin.Mode, plugin.SupervisorURL, plugin.HandlerAction, preflightTimeout, os.Stdin, out
+	plugin.Mode, plugin.SupervisorURL, plugin.HandlerAction, preflightTimeout, os.Stdin = "handler", localURL, "restart", time.Second, stdin
+	var buf bytes.Buffer
+	out = &buf
+	defer func() {
+		plugin.Mode, plugin.SupervisorURL, plugin.HandlerAction, preflightTimeout, os.Stdin, out = savedMode, savedURL, savedAction, savedPreflight, savedStdin, savedOut
+	}()
+
+	status, err := executeCheck(nil)
+	if err != nil || status != sensu.CheckStateOK {
+		t.Errorf("expected the handler to run without a local supervisor, got %s, %v: %s", statusName(status), err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "app.default: not loaded") {
+		t.Errorf("expected the event's supervisor to be asked, got %q", buf.String())
+	}
+}
+
+func TestDetectScheme(t *testing.T) {
+	savedURL, savedFallback := plugin.SupervisorURL, plugin.HTTPFallback
+	defer func() { plugin.SupervisorURL, plugin.HTTPFallback = savedURL, savedFallback }()
+	plugin.HTTPFallback = true
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	for _, c := range []struct {
+		url  string
+		want string
+	}{
+		{plain.URL, "http://"},
+		{secure.URL, "https://"},
+	} {
+		plugin.SupervisorURL = "https://" + strings.TrimPrefix(strings.TrimPrefix(c.url, "https://"), "http://")
+		if err := detectScheme(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(plugin.SupervisorURL, c.want) {
+			t.Errorf("%s: expected %s, got %s", c.url, c.want, plugin.SupervisorURL)
+		}
+	}
+
+	// plain HTTP is only accepted with the fallback
+	plugin.HTTPFallback = false
+	plugin.SupervisorURL = "https://" + strings.TrimPrefix(plain.URL, "http://")
+	if err := detectScheme(); err == nil || !strings.Contains(err.Error(), "--http-fallback is disabled") {
+		t.Errorf("expected a plain HTTP gateway to be rejected without the fallback, got %v", err)
+	}
+	plugin.HTTPFallback = true
+
+	closed := httptest.NewServer(handler)
+	closedHost := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+	plugin.SupervisorURL = "https://" + closedHost
+	if err := detectScheme(); !isConnRefused(err) {
+		t.Errorf("expected a refused connection to be reported rather than taken for plain HTTP, got %v", err)
+	}
+
+	// without a port the gateway port is probed, not that of the scheme
+	plugin.SupervisorURL = "https://127.0.0.1"
+	err := detectScheme()
+	if err != nil && !strings.Contains(err.Error(), "127.0.0.1:9631") {
+		t.Errorf("expected port 9631 to be probed, got %v", err)
+	} else if err == nil && !strings.HasSuffix(plugin.SupervisorURL, "127.0.0.1:9631") {
+		t.Errorf("expected port 9631 to be probed, got %s", plugin.SupervisorURL)
+	}
+}
+
+func TestCheckPeerInCensus(t *testing.T) {
+	gossip, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gossip.Close()
+	port := gossip.Addr().(*net.TCPAddr).Port
+
+	var butterfly ButterflyResponse
+	member := ButterflyMember{Health: "Alive"}
+	member.Member.ID = "abc123"
+	member.Member.Address = "127.0.0.1"
+	member.Member.GossipPort = port
+	butterfly.Member.Members = map[string]ButterflyMember{"abc123": member}
+
+	client := &http.Client{Timeout: time.Second}
+	peer := fmt.Sprintf("127.0.0.1:%d", port)
+
+	empty := &CensusResponse{CensusGroups: map[string]CensusGroup{}}
+	if r := checkPeer(peer, &butterfly, empty, client, false); r.Status != sensu.CheckStateWarning || r.Detail != "not in the census" {
+		t.Errorf("expected a peer missing from the census to warn, got %+v", r)
+	}
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"app.default": {Population: map[string]CensusMember{"abc123": {MemberID: "abc123", Alive: true}}},
+	}}
+	if r := checkPeer(peer, &butterfly, census, client, false); r.Status != sensu.CheckStateOK {
+		t.Errorf("expected a converged peer to be OK, got %+v", r)
+	}
+}
+
+func TestAuditGateway(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	saved := plugin.SupervisorURL
+	plugin.SupervisorURL = srv.URL
+	defer func() { plugin.SupervisorURL = saved }()
+
+	findings := auditGateway(srv.Client())
+	if len(findings) != 1 || !strings.Contains(findings[0].Message, "without an auth token") {
+		t.Errorf("expected only the missing auth token on a loopback gateway, got %+v", findings)
+	}
+}
+
+func TestOverallStatusWeighted(t *testing.T) {
+	savedWarn, savedCrit, savedWeights := plugin.ScoreWarn, plugin.ScoreCrit, serviceWeights
+	plugin.ScoreWarn, plugin.ScoreCrit = 1, 10
+	serviceWeights = map[string]int{"db.default": 5}
+	defer func() {
+		plugin.ScoreWarn, plugin.ScoreCrit, serviceWeights = savedWarn, savedCrit, savedWeights
+	}()
+
+	sidecar := []Health{
+		{ServiceGroup: "db.default", Status: sensu.CheckStateOK},
+		{ServiceGroup: "logs.default", Status: sensu.CheckStateCritical},
+	}
+	if status := overallStatus(sidecar, nil); status != sensu.CheckStateWarning {
+		t.Errorf("expected a failed sidecar to stay WARNING, got %s", statusName(status))
+	}
+
+	core := []Health{
+		{ServiceGroup: "db.default", Status: sensu.CheckStateCritical},
+		{ServiceGroup: "logs.default", Status: sensu.CheckStateOK},
+	}
+	if status := overallStatus(core, nil); status != sensu.CheckStateCritical {
+		t.Errorf("expected a failed core service to be CRITICAL, got %s", statusName(status))
+	}
+}
+
+func TestApplyDecodeErrors(t *testing.T) {
+	saved := plugin.DecodeErrorSeverity
+	plugin.DecodeErrorSeverity = "unknown"
+	defer func() { plugin.DecodeErrorSeverity = saved }()
+
+	health := []Health{
+		{ServiceGroup: "web.default", Status: sensu.CheckStateUnknown, Error: &decodeError{&gatewayError{Status: "200 OK"}}},
+		{ServiceGroup: "db.default", Status: sensu.CheckStateOK},
+	}
+	applyDecodeErrors(health)
+
+	if health[0].Reason != "unexpected supervisor response" {
+		t.Errorf("expected the decode failure to be named, got %q", health[0].Reason)
+	}
+	if status := overallStatus(health, nil); status != sensu.CheckStateUnknown {
+		t.Errorf("expected a decode failure to stay UNKNOWN, got %s", statusName(status))
+	}
+
+	health = append(health, Health{ServiceGroup: "logs.default", Status: sensu.CheckStateUnknown, Error: errors.New("connection reset")})
+	if status := overallStatus(health, nil); status != sensu.CheckStateCritical {
+		t.Errorf("expected other failures to be CRITICAL, got %s", statusName(status))
+	}
+}
+
+func TestCheckSupervisorDecodeErrors(t *testing.T) {
+	savedServices, savedSeverity := plugin.Services, plugin.DecodeErrorSeverity
+	plugin.Services, plugin.DecodeErrorSeverity = []string{"app.default"}, "warning"
+	defer func() { plugin.Services, plugin.DecodeErrorSeverity = savedServices, savedSeverity }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result":"ok"}`))
+	}))
+	defer srv.Close()
+
+	result := checkSupervisor(srv.URL, srv.Client())
+
+	if result.Status != sensu.CheckStateWarning {
+		t.Errorf("expected --decode-error-severity to apply to a discovered supervisor, got %s", statusName(result.Status))
+	}
+	if len(result.Health) != 1 || result.Health[0].Reason != "unexpected supervisor response" {
+		t.Errorf("expected the decode failure to be named, got %+v", result.Health)
+	}
+}
+
+func TestCompareViews(t *testing.T) {
+	local := censusView{"a": true, "b": true, "c": true, "d": true}
+
+	if got := compareViews(local, censusView{"a": true, "b": true, "c": true, "d": true}, 10); got != "" {
+		t.Errorf("expected matching views to agree, got %q", got)
+	}
+
+	want := "sees 3 alive, not c, d, also e"
+	if got := compareViews(local, censusView{"a": true, "b": true, "e": true}, 10); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := compareViews(local, censusView{"a": true, "b": true, "c": true}, 30); got != "" {
+		t.Errorf("expected one member out of four to be within 30%%, got %q", got)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "last.out")
+
+	var captured bytes.Buffer
+	restore, err := captureStdout(&captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(out, "app.default CRITICAL")
+	restore()
+
+	if captured.String() != "app.default CRITICAL" {
+		t.Errorf("captured %q", captured.String())
+	}
+
+	savedMaxSize, savedHeader := plugin.OutputFileMaxSize, plugin.OutputFileHeader
+	plugin.OutputFileMaxSize = 1
+	defer func() { plugin.OutputFileMaxSize, plugin.OutputFileHeader = savedMaxSize, savedHeader }()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := writeOutputFile(path, captured.Bytes(), sensu.CheckStateCritical, now); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != captured.String() {
+		t.Errorf("got %q, want exactly the output %q", data, captured.String())
+	}
+	os.Remove(path)
+
+	plugin.OutputFileHeader = true
+	if err := writeOutputFile(path, captured.Bytes(), sensu.CheckStateCritical, now); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if want := "# 2020-01-01T00:00:00Z CRITICAL\napp.default CRITICAL\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+
+	// past the size limit the next run starts a new file
+	if err := writeOutputFile(path, bytes.Repeat([]byte("x"), 2048), sensu.CheckStateOK, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOutputFile(path, []byte("ok"), sensu.CheckStateOK, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected a rotated backup: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.HasSuffix(string(data), "ok\n") || len(data) > 100 {
+		t.Errorf("expected the file to restart after rotation, got %d bytes", len(data))
+	}
+}
+
+func TestQuietPrintsNothingWhenOK(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/census":
+			w.Write([]byte(`{"census_groups":{"app.default":{"population":{"abc":{"member_id":"abc","service":"app","group":"default","alive":false}}}}}`))
+		case "/services":
+			w.Write([]byte(`[]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	savedURL, savedQuiet, savedServices, savedOut := plugin.SupervisorURL, plugin.Quiet, plugin.Services, out
+	savedMembers, savedChecks := expectedMembers, groupChecks
+	plugin.SupervisorURL, plugin.Quiet, plugin.Services = srv.URL, true, nil
+	expectedMembers, groupChecks, out = map[string]int{"app.default": 0}, nil, ioutil.Discard
+	defer func() {
+		plugin.SupervisorURL, plugin.Quiet, plugin.Services, out = savedURL, savedQuiet, savedServices, savedOut
+		expectedMembers, groupChecks = savedMembers, savedChecks
+	}()
+
+	for mode, execute := range map[string]func(*http.Client) (int, error){
+		"aggregate": executeAggregate,
+		"inventory": executeInventory,
+	} {
+		var buf bytes.Buffer
+		restore, err := captureStdout(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := execute(srv.Client())
+		restore()
+
+		if err != nil || status != sensu.CheckStateOK {
+			t.Errorf("%s: expected OK, got %s (%v)", mode, statusName(status), err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: expected nothing on stdout, got %q", mode, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	restore, err := captureStdout(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printQuiet(sensu.CheckStateWarning, "Aggregate WARNING: 1 service groups")
+	restore()
+	if buf.String() != "Aggregate WARNING: 1 service groups\n" {
+		t.Errorf("expected the one line summary when not OK, got %q", buf.String())
+	}
+}
+
+func TestCheckInstalledPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := plugin.HabRoot
+	plugin.HabRoot = dir
+	defer func() { plugin.HabRoot = saved }()
+
+	for _, release := range []string{"core/redis/5.0.7/20200101000000", "core/redis/5.0.7/20210101000000", "core/nginx/1.19.0/20200101000000"} {
+		if err := os.MkdirAll(filepath.Join(plugin.HabRoot, "pkgs", filepath.FromSlash(release)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings := checkInstalledPackages([]Health{
+		{ServiceGroup: "redis.default", Ident: "core/redis/5.0.7/20200101000000"},
+		{ServiceGroup: "nginx.default", Ident: "core/nginx/1.19.0/20200101000000"},
+	})
+
+	if len(findings) != 1 {
+		t.Fatalf("expected 1 finding, got %v", findings)
+	}
+	if findings[0].ServiceGroup != "redis.default" || !strings.Contains(findings[0].Message, "20210101000000") {
+		t.Errorf("unexpected finding %+v", findings[0])
+	}
+}
+
+func TestSendZabbix(t *testing.T) {
+	savedServer, savedHost, savedTimeout := plugin.ZabbixServer, plugin.ZabbixHost, plugin.Timeout
+	plugin.ZabbixHost, plugin.Timeout = "web1", 5
+	defer func() {
+		plugin.ZabbixServer, plugin.ZabbixHost, plugin.Timeout = savedServer, savedHost, savedTimeout
+	}()
+
+	health := []Health{{ServiceGroup: "app.default", Status: sensu.CheckStateWarning}}
+
+	for name, tc := range map[string]struct {
+		response []byte
+		wantErr  string
+	}{
+		"success":  {zabbixPacket([]byte(`{"response":"success","info":"processed: 2; failed: 0"}`)), ""},
+		"failed":   {zabbixPacket([]byte(`{"response":"failed","info":"processed: 0; failed: 2"}`)), `server responded "failed"`},
+		"header":   {[]byte("HTTP/1.1 400 Bad Request\r\n"), "unexpected response header"},
+		"too long": {append([]byte("ZBXD\x01"), 0, 0, 0, 0, 1, 0, 0, 0), "exceeds the limit"},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin.ZabbixServer = ln.Addr().String()
+
+		received := make(chan zabbixRequest, 1)
+		go func(response []byte) {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			var req zabbixRequest
+			header := make([]byte, 13)
+			if _, err := io.ReadFull(conn, header); err == nil && string(header[:5]) == "ZBXD\x01" {
+				body := make([]byte, binary.LittleEndian.Uint64(header[5:]))
+				if _, err := io.ReadFull(conn, body); err == nil {
+					json.Unmarshal(body, &req)
+				}
+			}
+			received <- req
+			conn.Write(response)
+		}(tc.response)
+
+		err = sendZabbix(health, sensu.CheckStateWarning)
+		ln.Close()
+
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		} else if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.wantErr, err)
+		}
+
+		want := zabbixRequest{Request: "sender data", Data: []zabbixItem{
+			{Host: "web1", Key: "habitat.health[app.default]", Value: "1"},
+			{Host: "web1", Key: "habitat.status", Value: "1"},
+		}}
+		if req := <-received; !reflect.DeepEqual(req, want) {
+			t.Errorf("%s: expected a framed %+v, got %+v", name, want, req)
+		}
+	}
+}
+
+func TestCheckGroups(t *testing.T) {
+	member := func(id, status string, alive bool) (CensusMember, func()) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/services/pg/default/health" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"status":%q}`, status)
+		}))
+		port := srv.Listener.Addr().(*net.TCPAddr).Port
+		return CensusMember{MemberID: id, Alive: alive, Sys: MemberSys{IP: "127.0.0.1", HTTPGatewayPort: port}}, srv.Close
+	}
+
+	population := map[string]CensusMember{}
+	for _, m := range []struct {
+		id, status string
+		alive      bool
+	}{
+		{"a", "OK", true},
+		{"b", "OK", true},
+		{"c", "CRITICAL", true},
+		{"d", "OK", false},
+	} {
+		cm, closeServer := member(m.id, m.status, m.alive)
+		defer closeServer()
+		population[m.id] = cm
+	}
+	// departed members no longer count towards the group
+	population["e"] = CensusMember{MemberID: "e", Departed: true}
+
+	census := &CensusResponse{CensusGroups: map[string]CensusGroup{
+		"pg.default": {Population: population},
+	}}
+
+	savedURL, savedChecks := plugin.SupervisorURL, groupChecks
+	plugin.SupervisorURL = "http://127.0.0.1:9631"
+	defer func() { plugin.SupervisorURL, groupChecks = savedURL, savedChecks }()
+
+	client := &http.Client{Timeout: time.Second}
+
+	groupChecks = map[string]int{"pg.default": 50}
+	if findings := checkGroups(census, client); len(findings) != 0 {
+		t.Errorf("expected 2 of 4 members OK to pass 50%%, got %+v", findings)
+	}
+
+	groupChecks = map[string]int{"pg.default": 51}
+	findings := checkGroups(census, client)
+	if len(findings) != 1 || findings[0].Status != sensu.CheckStateCritical || findings[0].Message != "2 of 4 members OK (50%), required 51%" {
+		t.Errorf("expected 2 of 4 members OK to fail 51%%, got %+v", findings)
+	}
+
+	groupChecks = map[string]int{"redis.default": 1}
+	findings = checkGroups(census, client)
+	if len(findings) != 1 || findings[0].Status != sensu.CheckStateCritical || !strings.Contains(findings[0].Message, "no members in the census") {
+		t.Errorf("expected a group missing from the census to fail, got %+v", findings)
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, srv.URL+"/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, srv.URL+"/census", http.StatusFound)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer srv.Close()
+
+	savedFollow, savedMax := plugin.FollowRedirects, plugin.MaxRedirects
+	defer func() { plugin.FollowRedirects, plugin.MaxRedirects = savedFollow, savedMax }()
+
+	client := &http.Client{CheckRedirect: checkRedirect}
+
+	for _, c := range []struct {
+		follow  bool
+		max     int
+		wantErr string
+	}{
+		{false, 10, "--follow-redirects is disabled"},
+		{true, 1, "stopped after 1 redirects"},
+		{true, 2, ""},
+	} {
+		plugin.FollowRedirects, plugin.MaxRedirects = c.follow, c.max
+
+		resp, err := client.Get(srv.URL + "/a")
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if c.wantErr == "" && (err != nil || resp.Request.URL.Path != "/census") {
+			t.Errorf("follow %t, max %d: expected /census to be reached, got %v", c.follow, c.max, err)
+		} else if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Errorf("follow %t, max %d: expected an error containing %q, got %v", c.follow, c.max, c.wantErr, err)
+		}
+	}
+}
+
+func TestOpenTunnel(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through the tunnel"))
+	}))
+	defer gateway.Close()
+
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "hab" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// a server that only forwards to the gateway, as sshd with
+	// AllowTcpForwarding does
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					if nc.ChannelType() != "direct-tcpip" {
+						nc.Reject(ssh.UnknownChannelType, "only port forwarding")
+						continue
+					}
+					var target struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+					if err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						remote.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+					go func() {
+						defer ch.Close()
+						defer remote.Close()
+						go io.Copy(remote, ch)
+						io.Copy(ch, remote)
+					}()
+				}
+			}()
+		}
+	}()
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostSigner.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedURL, savedSSH, savedKey, savedKnownHosts, savedTimeout := plugin.SupervisorURL, plugin.SSH, plugin.SSHKey, plugin.SSHKnownHosts, plugin.Timeout
+	defer func() {
+		plugin.SupervisorURL, plugin.SSH, plugin.SSHKey, plugin.SSHKnownHosts, plugin.Timeout = savedURL, savedSSH, savedKey, savedKnownHosts, savedTimeout
+	}()
+	plugin.SupervisorURL = gateway.URL
+	plugin.SSH = "hab@" + ln.Addr().String()
+	plugin.SSHKey, plugin.SSHKnownHosts, plugin.Timeout = keyFile, knownHosts, 5
+
+	closeTunnel, err := openTunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTunnel()
+
+	if plugin.SupervisorURL == gateway.URL {
+		t.Fatalf("expected the supervisor URL to point at the local end of the tunnel")
+	}
+	resp, err := http.Get(plugin.SupervisorURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "through the tunnel" {
+		t.Errorf("expected the gateway response through the tunnel, got %q", body)
+	}
+
+	// a host key that is not known is refused
+	if err := ioutil.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	plugin.SupervisorURL = gateway.URL
+	if closeOther, err := openTunnel(); err == nil {
+		closeOther()
+		t.Error("expected an unknown host key to be refused")
+	}
+}
+
+func TestExecuteHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake hab is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := filepath.Join(dir, "calls")
+	hab := "#!/bin/sh\necho \"$@\" >> " + calls + "\n[ -z \"$HAB_FAIL\" ]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "hab"), []byte(hab), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"service_group":"app.default","pkg":{"ident":"core/app/1.0.0/20200101000000"}}]`))
+	}))
+	defer gateway.Close()
+
+	savedPath, savedStdin, savedOut, savedAction := os.Getenv("PATH"), os.Stdin, out, plugin.HandlerAction
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+savedPath)
+	plugin.HandlerAction = "restart"
+	defer func() {
+		os.Setenv("PATH", savedPath)
+		os.Unsetenv("HAB_FAIL")
+		os.Stdin, out, plugin.HandlerAction = savedStdin, savedOut, savedAction
+	}()
+
+	run := func(status int) (int, string, error) {
+		event := fmt.Sprintf(`{"entity":{"metadata":{"name":"web-1"}},"check":{"status":%d,"metadata":{"name":"habitat","annotations":{%q:"app.default,db.default",%q:%q}}}}`,
+			status, plugin.Keyspace+"/service-group", plugin.Keyspace+"/supervisor-url", gateway.URL)
+		stdin, err := ioutil.TempFile(dir, "event")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdin.Close()
+		stdin.WriteString(event)
+		stdin.Seek(0, 0)
+		os.Stdin = stdin
+
+		var buf bytes.Buffer
+		out = &buf
+		result, err := executeHandler(gateway.Client())
+		return result, buf.String(), err
+	}
+
+	if status, output, err := run(sensu.CheckStateOK); err != nil || status != sensu.CheckStateOK || !strings.Contains(output, "nothing to do") {
+		t.Errorf("expected an OK event to be left alone, got %s, %v: %q", statusName(status), err, output)
+	}
+	if _, err := os.Stat(calls); !os.IsNotExist(err) {
+		t.Errorf("expected hab not to run for an OK event")
+	}
+
+	status, output, err := run(sensu.CheckStateCritical)
+	if err != nil || status != sensu.CheckStateOK {
+		t.Errorf("expected the restart to succeed, got %s, %v: %q", statusName(status), err, output)
+	}
+	if !strings.Contains(output, "db.default: not loaded on this supervisor, skipped") {
+		t.Errorf("expected db.default to be skipped, got %q", output)
+	}
+	if b, _ := ioutil.ReadFile(calls); string(b) != "svc restart core/app\n" {
+		t.Errorf("expected hab svc restart core/app, got %q", b)
+	}
+
+	os.Setenv("HAB_FAIL", "1")
+	if status, _, err := run(sensu.CheckStateCritical); status != sensu.CheckStateCritical || err == nil || err.Error() != "1 of 2 actions failed" {
+		t.Errorf("expected a failed restart to be CRITICAL, got %s, %v", statusName(status), err)
+	}
+}
+
+func TestExpectStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/db/default/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer srv.Close()
+
+	saved := expectedStatus
+	expectedStatus = map[string]string{"standby.default": "down", "db.default": "down"}
+	defer func() { expectedStatus = saved }()
+
+	health := checkServices(srv.URL, []string{"standby.default", "db.default", "app.default"}, srv.Client())
+	applyExpectedStatus(health)
+
+	for i, want := range []int{sensu.CheckStateOK, sensu.CheckStateWarning, sensu.CheckStateUnknown} {
+		if health[i].Status != want {
+			t.Errorf("expected %s to be %s, got %s", health[i].ServiceGroup, statusName(want), statusName(health[i].Status))
+		}
+	}
+	if health[0].Error != nil || health[0].Reason != "down as expected" {
+		t.Errorf("expected standby.default to be down as expected, got %+v", health[0])
+	}
+	if !isNotLoaded(health[2].Error) {
+		t.Errorf("expected app.default to keep its not loaded error, got %v", health[2].Error)
+	}
+}
+
+func TestWarningAs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"WARNING"}`))
+	}))
+	defer srv.Close()
+
+	saved := plugin.WarningAs
+	defer func() { plugin.WarningAs = saved }()
+
+	plugin.WarningAs = "warning"
+	if h := checkService(srv.URL, "app.default", srv.Client()); h.Status != sensu.CheckStateWarning || h.Reason != "" {
+		t.Errorf("expected WARNING to be kept, got %s (%s)", statusName(h.Status), h.Reason)
+	}
+
+	plugin.WarningAs = "ok"
+	if h := checkService(srv.URL, "app.default", srv.Client()); h.Status != sensu.CheckStateOK || !strings.Contains(h.Reason, "--warning-as ok") {
+		t.Errorf("expected WARNING to be reported as OK, got %s (%s)", statusName(h.Status), h.Reason)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricPoint is a single sample gathered during the run, printed in the
+// configured --metrics-format once the check completes.
+type metricPoint struct {
+	Name  string
+	Value float64
+	Tags  map[string]string
+}
+
+var metrics []metricPoint
+
+// extraLabels holds the parsed --label values.
+var extraLabels map[string]string
+
+func addMetric(name string, value float64, tags map[string]string) {
+	metrics = append(metrics, metricPoint{Name: name, Value: value, Tags: tags})
+}
+
+// serviceTags builds the tags of a per service metric. The rollout settings
+// and origin are only known when the service details were fetched, empty ones
+// are left out so they can be grouped on downstream when present.
+func serviceTags(serviceGroup string, ident string, channel string, topology string, updateStrategy string) map[string]string {
+	tags := map[string]string{"service_group": serviceGroup}
+	if id, err := parseIdent(ident); err == nil {
+		tags["origin"] = id.Origin
+	}
+	for k, v := range map[string]string{"channel": channel, "topology": topology, "update_strategy": updateStrategy} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+func printMetrics() {
+	now := time.Now()
+	host, _ := os.Hostname()
+
+	for _, m := range metrics {
+		// a metric's own tags win over --label
+		if len(extraLabels) > 0 {
+			tags := make(map[string]string, len(extraLabels)+len(m.Tags))
+			for k, v := range extraLabels {
+				tags[k] = v
+			}
+			for k, v := range m.Tags {
+				tags[k] = v
+			}
+			m.Tags = tags
+		}
+
+		switch plugin.MetricsFormat {
+		case "opentsdb":
+			fmt.Fprintln(os.Stdout, m.openTSDB(now, host))
+		default:
+			fmt.Fprintln(os.Stdout, m.prometheus())
+		}
+	}
+}
+
+func (m metricPoint) prometheus() string {
+	labels := make([]string, 0, len(m.Tags))
+	for _, k := range sortedKeys(m.Tags) {
+		labels = append(labels, k+"="+strconv.Quote(m.Tags[k]))
+	}
+
+	if len(labels) == 0 {
+		return fmt.Sprintf("%s %v", m.Name, m.Value)
+	}
+
+	return fmt.Sprintf("%s{%s} %v", m.Name, strings.Join(labels, ","), m.Value)
+}
+
+// openTSDB renders the point as a telnet style put line. The habitat_ prefix
+// becomes habitat. and every line carries a host tag, OpenTSDB requires at
+// least one.
+func (m metricPoint) openTSDB(now time.Time, host string) string {
+	tags := map[string]string{"host": host}
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+
+	var parts []string
+	for _, k := range sortedKeys(tags) {
+		// empty values are rejected
+		if tags[k] != "" {
+			parts = append(parts, openTSDBSafe(k)+"="+openTSDBSafe(tags[k]))
+		}
+	}
+
+	name := strings.Replace(m.Name, "_", ".", 1)
+
+	return fmt.Sprintf("put %s %d %v %s", name, now.Unix(), m.Value, strings.Join(parts, " "))
+}
+
+// openTSDBSafe replaces the characters OpenTSDB does not allow in names and
+// tag values.
+func openTSDBSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-' || r == '_' || r == '.' || r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// outputFormats lists the accepted --output-format values.
+var outputFormats = []string{"text", "table", "csv", "junit", "checkmk"}
+
+// linePlaceholders lists the placeholders accepted by --line-format.
+var linePlaceholders = []string{"{service}", "{status}", "{ident}", "{error}"}
+
+var linePlaceholder = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// formatLine renders a service with --line-format.
+func formatLine(h Health) string {
+	var errText string
+	if h.Error != nil {
+		errText = oneLine(h.Error.Error())
+	}
+
+	status := statusName(h.Status)
+	if h.Reason != "" {
+		status += " (" + h.Reason + ")"
+	}
+
+	return strings.NewReplacer(
+		"{service}", h.ServiceGroup,
+		"{status}", status,
+		"{ident}", h.Ident,
+		"{error}", errText,
+	).Replace(plugin.LineFormat)
+}
+
+// printText writes the compact output Sensu shows in the event, only
+// services that are not OK or are flagged for another reason are listed.
+func printText(health []Health, findings []Finding, status int) {
+	for _, h := range health {
+		if h.Status != sensu.CheckStateOK || h.Reason != "" {
+			if plugin.Timestamps && !h.Checked.IsZero() {
+				fmt.Fprintf(out, "%s ", h.Checked.Format(time.RFC3339))
+			}
+			if plugin.LineFormat != "" {
+				fmt.Fprintln(out, formatLine(h))
+			} else if h.Reason != "" {
+				fmt.Fprintf(out, "%s %s (%s)\n", h.ServiceGroup, statusName(h.Status), h.Reason)
+			} else {
+				fmt.Fprintf(out, "%s %s\n", h.ServiceGroup, statusName(h.Status))
+			}
+		}
+
+		// a line format showing the error replaces the separate block
+		if h.Error != nil && !strings.Contains(plugin.LineFormat, "{error}") {
+			fmt.Fprintf(out, "Error occured while checking service:\n%v\n", h.Error)
+		}
+	}
+
+	for _, f := range findings {
+		fmt.Fprintf(out, "%s %s: %s\n", f.ServiceGroup, statusName(f.Status), f.Message)
+	}
+
+	if status != sensu.CheckStateOK {
+		return
+	}
+
+	if len(health) > 0 {
+		fmt.Fprintf(out, "All health checks returning OK for loaded services")
+	} else {
+		fmt.Fprintf(out, "No services loaded")
+	}
+}
+
+// summary describes the whole run in a single line for --quiet.
+func summary(health []Health, findings []Finding, status int) string {
+	counts := map[int]int{}
+	for _, h := range health {
+		counts[h.Status]++
+	}
+
+	line := fmt.Sprintf("%s: %d services (%d ok, %d warning, %d critical, %d unknown)", statusName(status), len(health),
+		counts[sensu.CheckStateOK], counts[sensu.CheckStateWarning], counts[sensu.CheckStateCritical], counts[sensu.CheckStateUnknown])
+
+	if len(findings) > 0 {
+		line += fmt.Sprintf(", %d census findings", len(findings))
+	}
+
+	return line
+}
+
+// printQuiet writes the one line summary of --quiet to stdout, a run that is
+// OK prints nothing at all.
+func printQuiet(status int, line string) {
+	if status == sensu.CheckStateOK {
+		return
+	}
+	fmt.Fprintln(os.Stdout, line)
+}
+
+// printTable writes every service as an aligned table for interactive use.
+func printTable(health []Health, findings []Finding) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE GROUP\tSTATUS\tPKG IDENT\tUPTIME\tLAST ERROR")
+
+	for _, h := range health {
+		errText := ""
+		if h.Error != nil {
+			// keep the row on one line
+			errText = strings.Join(strings.Fields(h.Error.Error()), " ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", h.ServiceGroup, statusName(h.Status), h.Ident, uptime(h), errText)
+	}
+
+	w.Flush()
+
+	if len(findings) > 0 {
+		fmt.Fprintln(out)
+		for _, f := range findings {
+			fmt.Fprintf(out, "%s %s: %s\n", f.ServiceGroup, statusName(f.Status), f.Message)
+		}
+	}
+}
+
+// printCSV writes one row per service, ring findings follow as rows of their
+// own with the message in the error column. The columns are stable so the
+// rows can be appended to flat files.
+func printCSV(health []Health, findings []Finding) {
+	w := csv.NewWriter(out)
+	w.Write([]string{"service_group", "status", "pkg_ident", "process_state", "state_entered", "error"})
+
+	for _, h := range health {
+		entered := ""
+		if !h.StateEntered.IsZero() {
+			entered = h.StateEntered.UTC().Format(time.RFC3339)
+		}
+		errText := ""
+		if h.Error != nil {
+			errText = h.Error.Error()
+		}
+		w.Write([]string{h.ServiceGroup, statusName(h.Status), h.Ident, h.ProcessState, entered, errText})
+	}
+
+	for _, f := range findings {
+		w.Write([]string{f.ServiceGroup, statusName(f.Status), "", "", "", f.Message})
+	}
+
+	w.Flush()
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// printJUnit writes the results as a JUnit test suite with one test case per
+// service so CI systems can render them as a test report.
+func printJUnit(health []Health, findings []Finding) {
+	suite := junitTestSuite{Name: plugin.Name}
+
+	for _, h := range health {
+		tc := junitTestCase{ClassName: "services", Name: h.ServiceGroup}
+		if h.Status != sensu.CheckStateOK {
+			tc.Failure = &junitFailure{Message: h.ServiceGroup + " " + statusName(h.Status), Type: statusName(h.Status)}
+			if h.Error != nil {
+				tc.Failure.Text = h.Error.Error()
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	for _, f := range findings {
+		suite.Cases = append(suite.Cases, junitTestCase{
+			ClassName: "census",
+			Name:      f.ServiceGroup,
+			Failure:   &junitFailure{Message: f.Message, Type: statusName(f.Status)},
+		})
+	}
+
+	suite.Tests = len(suite.Cases)
+	for _, tc := range suite.Cases {
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+	}
+
+	fmt.Fprint(out, xml.Header)
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	enc.Encode(suite)
+	fmt.Fprintln(out)
+}
+
+// printCheckMK writes a Check_MK local check line per service, the status
+// codes match the Sensu ones.
+func printCheckMK(health []Health, findings []Finding) {
+	for _, h := range health {
+		msg := h.ServiceGroup + " " + statusName(h.Status)
+		if h.Error != nil {
+			msg += " - " + strings.Join(strings.Fields(h.Error.Error()), " ")
+		}
+		fmt.Fprintf(out, "%d %s health=%d %s\n", h.Status, checkMKName(h.ServiceGroup), h.Status, msg)
+	}
+
+	for _, f := range findings {
+		fmt.Fprintf(out, "%d %s - %s\n", f.Status, checkMKName(f.ServiceGroup+"_census"), f.Message)
+	}
+}
+
+// checkMKName makes a local check service name, which may not contain spaces.
+func checkMKName(name string) string {
+	return "Habitat_" + strings.Join(strings.Fields(name), "_")
+}
+
+func uptime(h Health) string {
+	if h.ProcessState != "" && h.ProcessState != "up" {
+		return h.ProcessState
+	}
+	if h.StateEntered.IsZero() {
+		return ""
+	}
+	return time.Since(h.StateEntered).Round(time.Second).String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// captureStdout sends everything written to stdout until the returned
+// function is called to buf as well, so --output-file gets the output Sensu
+// sees.
+func captureStdout(buf *bytes.Buffer) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := os.Stdout
+	prevOut := out
+	os.Stdout = w
+	if out == io.Writer(stdout) {
+		out = w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.MultiWriter(stdout, buf), r)
+		close(done)
+	}()
+
+	return func() {
+		w.Close()
+		<-done
+		r.Close()
+		os.Stdout = stdout
+		out = prevOut
+	}, nil
+}
+
+// writeOutputFile appends the output of a run to --output-file as it was
+// printed, preceded by a "# <time> <status>" line with --output-file-header.
+// The file is rotated to a single .1 backup once it grows past
+// --output-file-max-size.
+func writeOutputFile(path string, output []byte, status int, now time.Time) error {
+	if fi, err := os.Stat(path); err == nil && plugin.OutputFileMaxSize > 0 && fi.Size() >= int64(plugin.OutputFileMaxSize)*1024 {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	// Close does not report a write that failed, on a full disk for one
+	if err := writeRun(f, output, status, now); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeRun(w io.Writer, output []byte, status int, now time.Time) error {
+	if !plugin.OutputFileHeader {
+		_, err := w.Write(output)
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "# %s %s\n", now.UTC().Format(time.RFC3339), statusName(status)); err != nil {
+		return err
+	}
+	if _, err := w.Write(output); err != nil {
+		return err
+	}
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
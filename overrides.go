@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// serviceOverride holds the per service settings read from entity
+// annotations, zero values mean the setting is not overridden.
+type serviceOverride struct {
+	MinUptime   time.Duration
+	Severity    int
+	HasSeverity bool
+}
+
+// overrides holds the per service overrides keyed by service group.
+var overrides map[string]serviceOverride
+
+// overridesPrefix returns the annotation prefix for per service overrides,
+// e.g. sensu.io/plugins/sensu-habitat-check/config/overrides/postgres.default/min-uptime.
+func overridesPrefix() string {
+	return plugin.Keyspace + "/overrides/"
+}
+
+// applyEntityOverrides parses the override annotations into overrides, and
+// into expectedMembers and groupChecks for the census settings.
+func applyEntityOverrides(annotations map[string]string) error {
+	overrides = map[string]serviceOverride{}
+
+	prefix := overridesPrefix()
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		split := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+		if len(split) != 2 || !strings.Contains(split[0], ".") {
+			return fmt.Errorf("annotation %q malformed should be \"%sservice_name.service_group/setting\"", key, prefix)
+		}
+		group, setting := split[0], split[1]
+		o := overrides[group]
+
+		switch setting {
+		case "min-uptime":
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("annotation %q must be a non-negative number of seconds", key)
+			}
+			o.MinUptime = time.Duration(seconds) * time.Second
+		case "severity":
+			severity, err := parseSeverity(value)
+			if err != nil {
+				return fmt.Errorf("annotation %q %v", key, err)
+			}
+			o.Severity, o.HasSeverity = severity, true
+		case "expected-members":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("annotation %q count must be a non-negative integer", key)
+			}
+			expectedMembers[group] = n
+		case "group-check":
+			n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || n < 0 || n > 100 {
+				return fmt.Errorf("annotation %q percentage must be between 0 and 100", key)
+			}
+			groupChecks[group] = n
+		default:
+			return fmt.Errorf("annotation %q unknown setting %q, must be one of min-uptime, severity, expected-members or group-check", key, setting)
+		}
+
+		overrides[group] = o
+	}
+
+	return nil
+}
+
+// needsUptime reports whether any override requires the process details.
+func needsUptime() bool {
+	for _, o := range overrides {
+		if o.MinUptime > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOverrides warns about services up for less than their min-uptime and
+// replaces the severity of unhealthy services that have one configured.
+func applyOverrides(health []Health, now time.Time) {
+	for i, h := range health {
+		o, ok := overrides[h.ServiceGroup]
+		if !ok {
+			continue
+		}
+
+		if o.MinUptime > 0 && h.Status == sensu.CheckStateOK && !h.StateEntered.IsZero() {
+			if up := now.Sub(h.StateEntered); up < o.MinUptime {
+				health[i].Status = sensu.CheckStateWarning
+				health[i].Reason = fmt.Sprintf("up for %s, less than min-uptime %s", up.Truncate(time.Second), o.MinUptime)
+			}
+		}
+
+		if o.HasSeverity && health[i].Status != sensu.CheckStateOK && health[i].Status != o.Severity {
+			health[i].Status = o.Severity
+			if health[i].Reason == "" {
+				health[i].Reason = "severity overridden by entity annotation"
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// packageIdent is a fully qualified package identifier, origin/name/version/release.
+type packageIdent struct {
+	Origin  string
+	Name    string
+	Version string
+	Release string
+}
+
+func (p packageIdent) String() string {
+	return p.Origin + "/" + p.Name + "/" + p.Version + "/" + p.Release
+}
+
+func parseIdent(ident string) (packageIdent, error) {
+	parts := strings.Split(ident, "/")
+	if len(parts) != 4 {
+		return packageIdent{}, fmt.Errorf("package ident %q is not fully qualified", ident)
+	}
+	return packageIdent{Origin: parts[0], Name: parts[1], Version: parts[2], Release: parts[3]}, nil
+}
+
+// installedReleases lists the releases of origin/name installed under
+// --hab-root, release timestamps sort in build order.
+func installedReleases(origin string, name string) ([]packageIdent, error) {
+	dir := filepath.Join(plugin.HabRoot, "pkgs", origin, name)
+
+	versions, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []packageIdent
+	for _, v := range versions {
+		if !v.IsDir() {
+			continue
+		}
+		releases, err := ioutil.ReadDir(filepath.Join(dir, v.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range releases {
+			if r.IsDir() {
+				result = append(result, packageIdent{Origin: origin, Name: name, Version: v.Name(), Release: r.Name()})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// checkInstalledPackages warns about services running an older release than
+// the latest one installed locally, which will only be picked up on restart.
+func checkInstalledPackages(health []Health) []Finding {
+	var findings []Finding
+
+	for _, h := range health {
+		if h.Ident == "" {
+			continue
+		}
+
+		running, err := parseIdent(h.Ident)
+		if err != nil {
+			continue
+		}
+
+		installed, err := installedReleases(running.Origin, running.Name)
+		if err != nil {
+			findings = append(findings, Finding{
+				ServiceGroup: h.ServiceGroup,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("failed to list installed releases of %s/%s: %v", running.Origin, running.Name, err),
+			})
+			continue
+		}
+
+		latest := running
+		for _, p := range installed {
+			if p.Release > latest.Release {
+				latest = p
+			}
+		}
+
+		if latest != running {
+			findings = append(findings, Finding{
+				ServiceGroup: h.ServiceGroup,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("running %s but %s is installed, awaiting a restart", running, latest),
+			})
+		}
+	}
+
+	return findings
+}
+
+// checkOriginKeys warns about origins of loaded services without a public
+// key under --hab-root, the next update of those services would fail.
+func checkOriginKeys(health []Health) []Finding {
+	services := map[string][]string{}
+	for _, h := range health {
+		ident, err := parseIdent(h.Ident)
+		if err != nil {
+			continue
+		}
+		services[ident.Origin] = append(services[ident.Origin], h.ServiceGroup)
+	}
+
+	origins := make([]string, 0, len(services))
+	for origin := range services {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	var findings []Finding
+	for _, origin := range origins {
+		// keys are named origin-revision.pub
+		keys, err := filepath.Glob(filepath.Join(plugin.HabRoot, "cache", "keys", origin+"-*.pub"))
+		if err == nil && len(keys) > 0 {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			ServiceGroup: origin,
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("no public origin key in %s, updates of %s will fail", filepath.Join(plugin.HabRoot, "cache", "keys"), strings.Join(services[origin], ", ")),
+		})
+	}
+
+	return findings
+}
+
+// checkOldReleases warns about packages under --hab-root keeping more than
+// --max-old-releases releases besides the latest one.
+func checkOldReleases(max int) []Finding {
+	pkgs, err := filepath.Glob(filepath.Join(plugin.HabRoot, "pkgs", "*", "*"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(pkgs)
+
+	var findings []Finding
+	for _, dir := range pkgs {
+		name := filepath.Base(dir)
+		origin := filepath.Base(filepath.Dir(dir))
+
+		releases, err := installedReleases(origin, name)
+		if err != nil || len(releases)-1 <= max {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			ServiceGroup: origin + "/" + name,
+			Status:       sensu.CheckStateWarning,
+			Message:      fmt.Sprintf("%d old releases installed, more than %d, prune them with hab pkg uninstall --keep-latest", len(releases)-1, max),
+		})
+	}
+
+	return findings
+}
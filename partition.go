@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// censusView is the set of members one supervisor considers alive.
+type censusView map[string]bool
+
+func aliveMembers(census *CensusResponse) censusView {
+	view := censusView{}
+	for _, group := range census.CensusGroups {
+		for id, m := range group.Population {
+			if m.Alive {
+				view[id] = true
+			}
+		}
+	}
+	return view
+}
+
+// checkPartition fetches the census from up to --partition-check alive
+// members and compares their views of alive membership with the local one.
+// It returns a summary of the conflicting views when any differs by more than
+// --partition-tolerance percent, or an empty string.
+func checkPartition(census *CensusResponse, client *http.Client) string {
+	local := aliveMembers(census)
+
+	members := map[string]CensusMember{}
+	for _, group := range census.CensusGroups {
+		for id, m := range group.Population {
+			if m.Alive {
+				members[id] = m
+			}
+		}
+	}
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > plugin.PartitionCheck {
+		ids = ids[:plugin.PartitionCheck]
+	}
+
+	var conflicts []string
+	disagree := 0
+	for _, id := range ids {
+		m := members[id]
+		name := m.Sys.Hostname
+		if name == "" {
+			name = id
+		}
+
+		remote, err := getCensusFrom(m.gatewayURL(), client)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s unreachable: %v", name, err))
+			continue
+		}
+
+		if conflict := compareViews(local, aliveMembers(remote), plugin.PartitionTolerance); conflict != "" {
+			conflicts = append(conflicts, name+" "+conflict)
+			disagree++
+		}
+	}
+
+	// members that could not be asked are only context, they are as likely
+	// to be down as cut off
+	if disagree == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("census views disagree, this supervisor sees %d alive; %s", len(local), strings.Join(conflicts, "; "))
+}
+
+// compareViews describes how remote differs from local when the members
+// only one of them sees alive exceed tolerance percent of all members.
+func compareViews(local censusView, remote censusView, tolerance int) string {
+	var missing, extra []string
+	for id := range local {
+		if !remote[id] {
+			missing = append(missing, id)
+		}
+	}
+	for id := range remote {
+		if !local[id] {
+			extra = append(extra, id)
+		}
+	}
+
+	union := len(local) + len(extra)
+	if union == 0 || (len(missing)+len(extra))*100 <= tolerance*union {
+		return ""
+	}
+
+	sort.Strings(missing)
+	sort.Strings(extra)
+
+	s := fmt.Sprintf("sees %d alive", len(remote))
+	if len(missing) > 0 {
+		s += ", not " + strings.Join(missing, ", ")
+	}
+	if len(extra) > 0 {
+		s += ", also " + strings.Join(extra, ", ")
+	}
+	return s
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// defaultGossipPort is the port peers gossip on unless told otherwise.
+const defaultGossipPort = 9638
+
+// ButterflyResponse is the part of the gateway's /butterfly document listing
+// the members of the ring, including those running no services.
+type ButterflyResponse struct {
+	Member struct {
+		Members map[string]ButterflyMember `json:"members"`
+	} `json:"member"`
+}
+
+type ButterflyMember struct {
+	Member struct {
+		ID         string `json:"id"`
+		Address    string `json:"address"`
+		GossipPort int    `json:"gossip_port"`
+		Persistent bool   `json:"persistent"`
+	} `json:"member"`
+	Health string `json:"health"`
+}
+
+// PeerResult describes one configured permanent peer.
+type PeerResult struct {
+	Peer    string
+	Status  int
+	Health  string
+	Version string
+	Detail  string
+}
+
+// executePeers checks that every --peer is a live, permanent member of the
+// ring and that their supervisors run compatible versions.
+func executePeers(client *http.Client) (int, error) {
+	butterfly, err := getButterfly(client)
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("could not retrieve ring members: %v", err)
+	}
+
+	// the watch file is re-read by the supervisor, read it on every run too
+	var watched []string
+	var census *CensusResponse
+	if plugin.PeerWatchFile != "" {
+		if watched, err = readPeerWatchFile(plugin.PeerWatchFile); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+		if census, err = getCensus(client); err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("could not retrieve census: %v", err)
+		}
+	}
+
+	var results []PeerResult
+	versions := map[string][]string{}
+	for _, peer := range plugin.Peers {
+		r := checkPeer(peer, butterfly, nil, client, true)
+		if r.Version != "" {
+			versions[r.Version] = append(versions[r.Version], r.Peer)
+		}
+		results = append(results, r)
+	}
+	for _, peer := range watched {
+		r := checkPeer(peer, butterfly, census, client, false)
+		if r.Version != "" {
+			versions[r.Version] = append(versions[r.Version], r.Peer)
+		}
+		results = append(results, r)
+	}
+
+	status := sensu.CheckStateOK
+	alive := 0
+	for _, r := range results {
+		status = worseStatus(status, r.Status)
+		if r.Health == "alive" {
+			alive++
+		}
+	}
+
+	drift := ""
+	if plugin.VersionTolerance >= 0 {
+		if drift = versionDrift(versions, plugin.VersionTolerance); drift != "" {
+			status = worseStatus(status, sensu.CheckStateWarning)
+		}
+	}
+
+	kind := "permanent peers"
+	if len(watched) > 0 {
+		kind = "peers"
+	}
+	headline := fmt.Sprintf("Ring backbone %s: %d of %d %s alive", statusName(status), alive, len(results), kind)
+	if plugin.Quiet {
+		printQuiet(status, headline)
+		return status, nil
+	}
+
+	fmt.Fprintln(out, headline)
+	for _, r := range results {
+		line := fmt.Sprintf("%s %s %s", r.Peer, statusName(r.Status), r.Health)
+		if r.Version != "" {
+			line += " " + r.Version
+		}
+		if r.Detail != "" {
+			line += " (" + r.Detail + ")"
+		}
+		fmt.Fprintln(out, line)
+	}
+	if drift != "" {
+		fmt.Fprintln(out, drift)
+	}
+
+	return status, nil
+}
+
+func getButterfly(client *http.Client) (*ButterflyResponse, error) {
+	resp, err := gatewayGet(client, getSupervisorUrl()+"/butterfly")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var result ButterflyResponse
+	if err := decodeJSON(resp, &result, "butterfly"); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// checkPeer finds peer, given as host[:gossip_port], among the ring members
+// and asks its gateway for the supervisor version. Peers from the watch file
+// need not be permanent, their gossip port has to accept connections and
+// they have to show up in census instead.
+func checkPeer(peer string, butterfly *ButterflyResponse, census *CensusResponse, client *http.Client, permanent bool) PeerResult {
+	result := PeerResult{Peer: peer, Status: sensu.CheckStateCritical, Health: "missing"}
+
+	host, port, err := splitPeer(peer)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+
+	if !permanent {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), probeTimeout)
+		if err != nil {
+			result.Health = "unreachable"
+			result.Detail = err.Error()
+			return result
+		}
+		conn.Close()
+	}
+
+	var member *ButterflyMember
+	for _, id := range sortedButterflyIDs(butterfly) {
+		m := butterfly.Member.Members[id]
+		if m.Member.GossipPort == port && contains(addrs, m.Member.Address) {
+			member = &m
+			break
+		}
+	}
+	if member == nil {
+		result.Detail = "not a member of the ring"
+		return result
+	}
+
+	result.Health = strings.ToLower(member.Health)
+	switch result.Health {
+	case "alive":
+		result.Status = sensu.CheckStateOK
+	case "suspect":
+		result.Status = sensu.CheckStateWarning
+	}
+
+	if permanent && !member.Member.Persistent {
+		result.Status = worseStatus(result.Status, sensu.CheckStateWarning)
+		result.Detail = "not a permanent peer"
+	}
+
+	// gossip reaching the peer is not enough, the rings have to have merged
+	if census != nil && !inCensus(census, member.Member.ID, host, addrs) {
+		result.Status = worseStatus(result.Status, sensu.CheckStateWarning)
+		result.Detail = "not in the census"
+	}
+
+	if result.Health == "alive" {
+		sys, err := getSupervisorSys(peerGatewayURL(member.Member.Address), client)
+		if err == nil && sys != nil {
+			result.Version = sys.Version
+		}
+	}
+
+	return result
+}
+
+// readPeerWatchFile reads the peers listed one per line in a supervisor
+// --peer-watch-file, skipping blank lines and comments.
+func readPeerWatchFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --peer-watch-file: %v", err)
+	}
+
+	var peers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+
+	return peers, nil
+}
+
+// splitPeer splits a --peer value the way hab sup run --peer takes it, the
+// gossip port defaults to 9638.
+func splitPeer(peer string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(peer)
+	if err != nil {
+		return peer, defaultGossipPort, nil
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid gossip port %q", portText)
+	}
+
+	return host, port, nil
+}
+
+// peerGatewayURL assumes peers expose their gateway like --supervisor-url.
+func peerGatewayURL(address string) string {
+	u, err := url.Parse(getSupervisorUrl())
+	if err != nil {
+		return "http://" + net.JoinHostPort(address, "9631")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "9631"
+	}
+
+	return u.Scheme + "://" + net.JoinHostPort(address, port)
+}
+
+func sortedButterflyIDs(butterfly *ButterflyResponse) []string {
+	ids := make([]string, 0, len(butterfly.Member.Members))
+	for id := range butterfly.Member.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// inCensus reports whether a ring member appears in any census group, by
+// member id or by the host it runs on.
+func inCensus(census *CensusResponse, memberID string, host string, addrs []string) bool {
+	for _, group := range census.CensusGroups {
+		for id, m := range group.Population {
+			if id == memberID || m.MemberID == memberID || strings.EqualFold(m.Sys.Hostname, host) || contains(addrs, m.Sys.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
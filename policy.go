@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// checkForbiddenChannels reports services tracking one of the channels
+// named by --forbid-channel, such as unstable in production.
+func checkForbiddenChannels(health []Health) []Finding {
+	var result []Finding
+
+	for _, h := range health {
+		if h.Channel == "" {
+			continue
+		}
+		for _, channel := range plugin.ForbidChannel {
+			if strings.EqualFold(h.Channel, channel) {
+				result = append(result, Finding{
+					ServiceGroup: h.ServiceGroup,
+					Status:       sensu.CheckStateWarning,
+					Message:      fmt.Sprintf("tracks the %s channel, forbidden on this host", h.Channel),
+				})
+				break
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probePorts holds the parsed --probe-ports values.
+var probePorts []int
+
+// probeTimeout bounds each connection attempt while probing.
+const probeTimeout = 2 * time.Second
+
+// schemeOmitted is set when --supervisor-url was given without a scheme and
+// it has to be detected.
+var schemeOmitted bool
+
+// detectScheme switches the supervisor URL to HTTPS when the gateway completes
+// a TLS handshake, otherwise to HTTP unless the fallback is disabled. Without
+// a port the gateway's own 9631 is used rather than that of the scheme.
+func detectScheme() error {
+	u, err := url.Parse(plugin.SupervisorURL)
+	if err != nil {
+		return err
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "9631")
+	}
+
+	// a gateway that cannot be reached says nothing about TLS
+	conn, err := net.DialTimeout("tcp", u.Host, probeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// only asking whether the gateway speaks TLS, the certificate is
+	// verified by the requests that follow
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+	err = tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: u.Hostname()}).Handshake()
+	if err == nil {
+		u.Scheme = "https"
+	} else if plugin.HTTPFallback {
+		u.Scheme = "http"
+	} else {
+		return fmt.Errorf("supervisor gateway %s did not complete a TLS handshake and --http-fallback is disabled: %v", u.Host, err)
+	}
+
+	plugin.SupervisorURL = u.String()
+	return nil
+}
+
+// preflight dials the gateway once so an unreachable supervisor is reported
+// within timeout instead of after the full request timeout.
+func preflight(timeout time.Duration) error {
+	u, err := url.Parse(getSupervisorUrl())
+	if err != nil {
+		return err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeSupervisorPort points the supervisor URL at the first of the
+// candidate ports accepting connections.
+func probeSupervisorPort() error {
+	u, err := url.Parse(plugin.SupervisorURL)
+	if err != nil {
+		return err
+	}
+
+	for _, port := range probePorts {
+		addr := net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		u.Host = addr
+		plugin.SupervisorURL = u.String()
+		return nil
+	}
+
+	return fmt.Errorf("no supervisor gateway answering on %s ports %s", u.Hostname(), joinInts(probePorts))
+}
+
+// parsePorts accepts repeated and comma separated port numbers.
+func parsePorts(flag string, values []string) ([]int, error) {
+	var ports []int
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("%s %q is not a valid port", flag, p)
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// supervisorProcess reads the resource usage of the hab-sup process from
+// /proc, finding it through the supervisor's LOCK file or its name.
+func supervisorProcess() (*processStats, error) {
+	pid, err := supervisorPID()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &processStats{PID: pid}
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	f, err := os.Open(filepath.Join(dir, "status"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "VmRSS:":
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			stats.RSS = kb * 1024
+		case "Threads:":
+			stats.Threads, _ = strconv.Atoi(fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count open files of hab-sup (pid %d), the check may need to run as the supervisor user: %v", pid, err)
+	}
+	stats.FDs = len(fds)
+
+	return stats, nil
+}
+
+func supervisorPID() (int, error) {
+	// the supervisor writes its pid to the LOCK file of its state directory
+	if data, err := ioutil.ReadFile(filepath.Join(plugin.HabRoot, "sup", "default", "LOCK")); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+				return pid, nil
+			}
+		}
+	}
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == "hab-sup" {
+			return pid, nil
+		}
+	}
+
+	return 0, fmt.Errorf("hab-sup process not found")
+}
+
+// supervisorInstance identifies the running hab-sup process by its pid and
+// start time, which changes whenever the supervisor restarts.
+func supervisorInstance() (string, error) {
+	pid, err := supervisorPID()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", err
+	}
+
+	// the command name may contain spaces, the fields after it do not;
+	// starttime is the 22nd field, the 20th after the name
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	return strconv.Itoa(pid) + ":" + fields[19], nil
+}
+
+// supervisorArgs returns the command line hab-sup was started with.
+func supervisorArgs() ([]string, error) {
+	pid, err := supervisorPID()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
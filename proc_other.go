@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func supervisorProcess() (*processStats, error) {
+	return nil, fmt.Errorf("supervisor process thresholds are not supported on %s", runtime.GOOS)
+}
+
+func supervisorInstance() (string, error) {
+	return "", fmt.Errorf("supervisor restart detection is not supported on %s", runtime.GOOS)
+}
+
+func supervisorArgs() ([]string, error) {
+	return nil, fmt.Errorf("reading the supervisor command line is not supported on %s", runtime.GOOS)
+}
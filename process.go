@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// processStats is the resource usage of the hab-sup process.
+type processStats struct {
+	PID     int
+	RSS     uint64
+	FDs     int
+	Threads int
+}
+
+// processChecksEnabled reports whether any hab-sup threshold is set.
+func processChecksEnabled() bool {
+	return plugin.SupRSSWarn > 0 || plugin.SupRSSCrit > 0 ||
+		plugin.SupFDsWarn > 0 || plugin.SupFDsCrit > 0 ||
+		plugin.SupThreadsWarn > 0 || plugin.SupThreadsCrit > 0
+}
+
+// checkSupervisorProcess compares the hab-sup process against the
+// --sup-rss, --sup-fds and --sup-threads thresholds.
+func checkSupervisorProcess() []Finding {
+	stats, err := supervisorProcess()
+	if err != nil {
+		return []Finding{{ServiceGroup: "hab-sup", Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+
+	addMetric("habitat_supervisor_rss_bytes", float64(stats.RSS), nil)
+	addMetric("habitat_supervisor_open_fds", float64(stats.FDs), nil)
+	addMetric("habitat_supervisor_threads", float64(stats.Threads), nil)
+
+	var findings []Finding
+	for _, c := range []struct {
+		what       string
+		value      int
+		warn, crit int
+		unit       string
+	}{
+		{"resident memory", int(stats.RSS / 1024 / 1024), plugin.SupRSSWarn, plugin.SupRSSCrit, "MB"},
+		{"open files", stats.FDs, plugin.SupFDsWarn, plugin.SupFDsCrit, ""},
+		{"threads", stats.Threads, plugin.SupThreadsWarn, plugin.SupThreadsCrit, ""},
+	} {
+		status, threshold := sensu.CheckStateOK, 0
+		if c.crit > 0 && c.value >= c.crit {
+			status, threshold = sensu.CheckStateCritical, c.crit
+		} else if c.warn > 0 && c.value >= c.warn {
+			status, threshold = sensu.CheckStateWarning, c.warn
+		}
+		if status == sensu.CheckStateOK {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			ServiceGroup: "hab-sup",
+			Status:       status,
+			Message:      fmt.Sprintf("%s %d%s (pid %d), threshold %d%s", c.what, c.value, c.unit, stats.PID, threshold, c.unit),
+		})
+	}
+
+	return findings
+}
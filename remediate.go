@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// remediationDue returns the service groups that have just been CRITICAL for
+// --remediate-after consecutive runs, each streak is remediated once.
+func remediationDue(state *State) []string {
+	var due []string
+	for _, group := range sortedServiceGroups(state) {
+		s := state.Services[group]
+		if s.Status == sensu.CheckStateCritical && s.Runs == plugin.RemediateAfter {
+			due = append(due, group)
+		}
+	}
+	return due
+}
+
+// remediate restarts the given services with hab svc restart on the checked
+// supervisor and reports every action as a finding so it shows up in the
+// check output.
+func remediate(groups []string, health []Health) []Finding {
+	idents := make(map[string]string, len(health))
+	for _, h := range health {
+		idents[h.ServiceGroup] = h.Ident
+	}
+
+	var findings []Finding
+	for _, group := range groups {
+		ident, err := parseIdent(idents[group])
+		if err != nil {
+			findings = append(findings, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("remediation skipped, package unknown: %v", err),
+			})
+			continue
+		}
+
+		pkg := ident.Origin + "/" + ident.Name
+		output, err := habSvc(getSupervisorUrl(), "restart", pkg)
+		if err != nil {
+			findings = append(findings, Finding{
+				ServiceGroup: group,
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("remediation failed, hab svc restart %s: %v %s", pkg, err, oneLine(string(output))),
+			})
+			continue
+		}
+
+		findings = append(findings, Finding{
+			ServiceGroup: group,
+			Status:       sensu.CheckStateOK,
+			Message:      fmt.Sprintf("remediated with hab svc restart %s after %d CRITICAL runs", pkg, plugin.RemediateAfter),
+		})
+	}
+
+	return findings
+}
+
+func sortedServiceGroups(state *State) []string {
+	groups := make([]string, 0, len(state.Services))
+	for group := range state.Services {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RunReport is the JSON document describing a single check run, shared by
+// the integrations that ship results elsewhere.
+type RunReport struct {
+	Timestamp     time.Time         `json:"timestamp"`
+	SupervisorURL string            `json:"supervisor_url"`
+	Supervisor    *SysInfo          `json:"supervisor,omitempty"`
+	Status        string            `json:"status"`
+	Services      []ServiceReport   `json:"services"`
+	Findings      []FindingReport   `json:"findings,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+type ServiceReport struct {
+	ServiceGroup   string `json:"service_group"`
+	Status         string `json:"status"`
+	Reason         string `json:"reason,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Origin         string `json:"origin,omitempty"`
+	Channel        string `json:"channel,omitempty"`
+	Topology       string `json:"topology,omitempty"`
+	UpdateStrategy string `json:"update_strategy,omitempty"`
+}
+
+type FindingReport struct {
+	ServiceGroup string `json:"service_group"`
+	Status       string `json:"status"`
+	Message      string `json:"message"`
+}
+
+func buildReport(health []Health, findings []Finding, status int) RunReport {
+	report := RunReport{
+		Timestamp:     time.Now().UTC(),
+		SupervisorURL: getSupervisorUrl(),
+		Supervisor:    runSupervisor,
+		Status:        statusName(status),
+		Services:      []ServiceReport{},
+		Labels:        extraLabels,
+	}
+
+	for _, h := range health {
+		sr := ServiceReport{
+			ServiceGroup:   h.ServiceGroup,
+			Status:         statusName(h.Status),
+			Reason:         h.Reason,
+			Origin:         h.tags()["origin"],
+			Channel:        h.Channel,
+			Topology:       h.Topology,
+			UpdateStrategy: h.UpdateStrategy,
+		}
+		if h.Error != nil {
+			sr.Error = h.Error.Error()
+		}
+		report.Services = append(report.Services, sr)
+	}
+
+	for _, f := range findings {
+		report.Findings = append(report.Findings, FindingReport{
+			ServiceGroup: f.ServiceGroup,
+			Status:       statusName(f.Status),
+			Message:      f.Message,
+		})
+	}
+
+	return report
+}
+
+// postWebhook sends the run report to --webhook-url, signing the body when a
+// secret is configured so the receiver can verify where it came from.
+func postWebhook(client *http.Client, report RunReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{}
+	if plugin.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(plugin.WebhookSecret))
+		mac.Write(body)
+		headers["X-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return postJSON(client, plugin.WebhookURL, body, headers)
+}
+
+// shippedReport is the run report as indexed by Elasticsearch or Logstash.
+type shippedReport struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Host      string    `json:"host"`
+	RunReport
+}
+
+// shipReport sends the run report as a document to --ship-url, an
+// Elasticsearch index (.../index/_doc) or a Logstash HTTP input.
+func shipReport(client *http.Client, report RunReport) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(shippedReport{Timestamp: report.Timestamp, Host: host, RunReport: report})
+	if err != nil {
+		return err
+	}
+
+	return postJSON(client, plugin.ShipURL, body, nil)
+}
+
+func postJSON(client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+
+	return nil
+}
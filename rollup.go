@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// rollupStrategy holds the parsed --aggregate strategy.
+var rollupStrategy = aggregateStrategy{Name: "worst"}
+
+// aggregateStrategy describes how the results of several supervisors or
+// members roll up into one status.
+type aggregateStrategy struct {
+	Name    string
+	Percent int
+}
+
+func parseAggregateStrategy(value string) (aggregateStrategy, error) {
+	switch value {
+	case "worst", "majority", "quorum":
+		return aggregateStrategy{Name: value}, nil
+	}
+
+	if strings.HasPrefix(value, "percent:") {
+		n, err := strconv.Atoi(strings.TrimPrefix(value, "percent:"))
+		if err == nil && n >= 0 && n <= 100 {
+			return aggregateStrategy{Name: "percent", Percent: n}, nil
+		}
+	}
+
+	return aggregateStrategy{}, fmt.Errorf("%q invalid, must be worst, majority, quorum or percent:N", value)
+}
+
+// rollup combines statuses according to the strategy:
+//
+//	worst     the most severe status
+//	majority  the status shared by most results, ties go to the worse one
+//	quorum    CRITICAL unless more than half are OK, WARNING unless all are
+//	percent:N CRITICAL unless at least N% are OK, WARNING unless all are
+func (s aggregateStrategy) rollup(statuses []int) int {
+	if len(statuses) == 0 {
+		return sensu.CheckStateOK
+	}
+
+	counts := map[int]int{}
+	worst := sensu.CheckStateOK
+	for _, st := range statuses {
+		worst = worseStatus(worst, st)
+		// an unknown result counts as critical, as in the single check
+		if st == sensu.CheckStateUnknown {
+			st = sensu.CheckStateCritical
+		}
+		counts[st]++
+	}
+
+	switch s.Name {
+	case "majority":
+		best, bestCount := sensu.CheckStateOK, -1
+		for _, st := range []int{sensu.CheckStateOK, sensu.CheckStateWarning, sensu.CheckStateCritical} {
+			if counts[st] >= bestCount {
+				best, bestCount = st, counts[st]
+			}
+		}
+		return best
+	case "quorum":
+		return okShare(counts[sensu.CheckStateOK], len(statuses), counts[sensu.CheckStateOK]*2 > len(statuses))
+	case "percent":
+		return okShare(counts[sensu.CheckStateOK], len(statuses), counts[sensu.CheckStateOK]*100 >= s.Percent*len(statuses))
+	}
+
+	return worst
+}
+
+func okShare(ok int, total int, enough bool) int {
+	if !enough {
+		return sensu.CheckStateCritical
+	} else if ok < total {
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateOK
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// serviceWeights holds the parsed --weight values, services without one
+// weigh 1.
+var serviceWeights map[string]int
+
+func scoringEnabled() bool {
+	return plugin.ScoreWarn > 0 || plugin.ScoreCrit > 0
+}
+
+// healthScore adds up the weights of the failing services, a WARNING counts
+// its weight once and a CRITICAL or UNKNOWN twice.
+func healthScore(health []Health) int {
+	score := 0
+	for _, h := range health {
+		weight, ok := serviceWeights[h.ServiceGroup]
+		if !ok {
+			weight = 1
+		}
+
+		switch h.Status {
+		case sensu.CheckStateWarning:
+			score += weight
+		case sensu.CheckStateCritical, sensu.CheckStateUnknown:
+			score += 2 * weight
+		}
+	}
+	return score
+}
+
+// scoreStatus maps a health score onto --score-warn and --score-crit.
+func scoreStatus(score int) int {
+	if plugin.ScoreCrit > 0 && score >= plugin.ScoreCrit {
+		return sensu.CheckStateCritical
+	}
+	if plugin.ScoreWarn > 0 && score >= plugin.ScoreWarn {
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateOK
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// auditGateway reports the hardening gaps --security-audit looks for: a
+// gateway answering without an auth token, and one serving plaintext HTTP
+// beyond the loopback interface.
+func auditGateway(client *http.Client) []Finding {
+	var result []Finding
+
+	// ask without the token, whether or not one is configured
+	req, err := http.NewRequest("GET", getSupervisorUrl()+"/services", nil)
+	if err != nil {
+		return []Finding{{ServiceGroup: "gateway", Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+	req.Header.Set("Accept", "application/json")
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			result = append(result, Finding{
+				ServiceGroup: "gateway",
+				Status:       sensu.CheckStateWarning,
+				Message:      "answers without an auth token, set HAB_SUP_GATEWAY_AUTH_TOKEN",
+			})
+		}
+	}
+
+	u, err := url.Parse(plugin.SupervisorURL)
+	if err != nil || u.Scheme != "http" {
+		return result
+	}
+
+	// the listen address comes with the loaded services, without any the
+	// address the check connects to is all there is to go on
+	listen := u.Hostname()
+	port := u.Port()
+	sys, _ := getSupervisorSys(getSupervisorUrl(), client)
+	if sys != nil {
+		listen = sys.HTTPGatewayIP
+		port = strconv.Itoa(sys.HTTPGatewayPort)
+	}
+
+	if isLoopback(listen) {
+		return result
+	}
+
+	// an answer on the host's own address shows plaintext is accepted from
+	// off-host rather than just configured
+	if sys != nil && sys.IP != "" {
+		addr := net.JoinHostPort(sys.IP, port)
+		if resp, err := client.Get("http://" + addr + "/services"); err == nil {
+			resp.Body.Close()
+			return append(result, Finding{
+				ServiceGroup: "gateway",
+				Status:       sensu.CheckStateWarning,
+				Message:      fmt.Sprintf("accepts plaintext HTTP from off-host on %s, start the supervisor with --listen-http on loopback or with TLS", addr),
+			})
+		}
+	}
+
+	return append(result, Finding{
+		ServiceGroup: "gateway",
+		Status:       sensu.CheckStateWarning,
+		Message:      fmt.Sprintf("listens on %s without TLS", net.JoinHostPort(listen, port)),
+	})
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
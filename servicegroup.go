@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// serviceGroup is a parsed Habitat service group in its complete form,
+// [application.environment#]service.group[@organization].
+type serviceGroup struct {
+	Application  string
+	Environment  string
+	Service      string
+	Group        string
+	Organization string
+}
+
+func parseServiceGroup(s string) (serviceGroup, error) {
+	var sg serviceGroup
+	rest := s
+
+	if i := strings.Index(rest, "#"); i >= 0 {
+		appEnv := strings.SplitN(rest[:i], ".", 2)
+		if len(appEnv) != 2 || appEnv[0] == "" || appEnv[1] == "" {
+			return sg, fmt.Errorf("service group %q has a malformed application.environment", s)
+		}
+		sg.Application, sg.Environment = appEnv[0], appEnv[1]
+		rest = rest[i+1:]
+	}
+
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		sg.Organization = rest[i+1:]
+		if sg.Organization == "" {
+			return sg, fmt.Errorf("service group %q has an empty organization", s)
+		}
+		rest = rest[:i]
+	}
+
+	split := strings.SplitN(rest, ".", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return sg, fmt.Errorf("service group %q is not in format service_name.service_group", s)
+	}
+	sg.Service, sg.Group = split[0], split[1]
+
+	return sg, nil
+}
+
+// gatewayPath is the gateway path of the service, the organization is its
+// own path segment while application and environment are not part of it.
+func (sg serviceGroup) gatewayPath() string {
+	p := "/services/" + url.PathEscape(sg.Service) + "/" + url.PathEscape(sg.Group)
+	if sg.Organization != "" {
+		p += "/" + url.PathEscape(sg.Organization)
+	}
+	return p
+}
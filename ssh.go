@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// openTunnel connects to --ssh and forwards a local port to the supervisor
+// URL as seen from that host, so a gateway bound to its loopback interface
+// can be checked remotely. The supervisor URL is pointed at the local end,
+// the returned function closes the tunnel.
+func openTunnel() (func(), error) {
+	u, err := url.Parse(plugin.SupervisorURL)
+	if err != nil {
+		return nil, err
+	}
+	target := u.Host
+	if u.Port() == "" {
+		target = net.JoinHostPort(u.Hostname(), "9631")
+	}
+
+	config, addr, err := sshConfig(plugin.SSH)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("ssh to %s failed: %v", addr, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			local, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go forward(local, client, target)
+		}
+	}()
+
+	u.Host = ln.Addr().String()
+	plugin.SupervisorURL = u.String()
+
+	return func() {
+		ln.Close()
+		client.Close()
+	}, nil
+}
+
+func forward(local net.Conn, client *ssh.Client, target string) {
+	defer local.Close()
+
+	remote, err := client.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+
+	go io.Copy(remote, local)
+	io.Copy(local, remote)
+}
+
+// sshConfig builds the client configuration for a --ssh user@host[:port]
+// destination. Keys come from --ssh-key or the running ssh-agent, the host
+// key is verified against --ssh-known-hosts.
+func sshConfig(dest string) (*ssh.ClientConfig, string, error) {
+	split := strings.SplitN(dest, "@", 2)
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return nil, "", fmt.Errorf("--ssh %q malformed should be \"user@host[:port]\"", dest)
+	}
+	user, addr := split[0], split[1]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if plugin.SSHKey != "" {
+		key, err := ioutil.ReadFile(expandHome(plugin.SSHKey))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read --ssh-key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse --ssh-key %s: %v", plugin.SSHKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to connect to ssh-agent: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	} else {
+		return nil, "", fmt.Errorf("--ssh requires --ssh-key or a running ssh-agent")
+	}
+
+	hostKeys, err := knownhosts.New(expandHome(plugin.SSHKnownHosts))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read --ssh-known-hosts: %v", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         time.Duration(plugin.Timeout) * time.Second,
+	}, addr, nil
+}
+
+// expandHome resolves a leading ~/ to the home directory of the check user.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// State is persisted to --state-file between runs so checks can reason about
+// how long a service has been in its current status.
+type State struct {
+	Services map[string]ServiceState `json:"services"`
+
+	// Supervisor identifies the hab-sup process seen on the last run
+	Supervisor string `json:"supervisor,omitempty"`
+
+	// Elections holds since when each unfinished election has been seen,
+	// keyed by service group and election kind
+	Elections map[string]time.Time `json:"elections,omitempty"`
+}
+
+type ServiceState struct {
+	// Status is the status the supervisor reported, before any escalation
+	Status int       `json:"status"`
+	Since  time.Time `json:"since"`
+
+	// Runs counts the consecutive runs the service has had this status
+	Runs int `json:"runs,omitempty"`
+
+	// Transitions holds the times of recent status changes, kept for the
+	// length of --flap-window
+	Transitions []time.Time `json:"transitions,omitempty"`
+}
+
+func loadState(path string) (*State, error) {
+	state := &State{Services: map[string]ServiceState{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %s: %v", path, err)
+	}
+
+	if state.Services == nil {
+		state.Services = map[string]ServiceState{}
+	}
+
+	return state, nil
+}
+
+// save writes the state next to its final location first so a reader never
+// sees a partially written file.
+func (s *State) save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// applyState records the current status of every service in state, marks
+// services changing status too often as flapping and escalates services that
+// have been WARNING for longer than --escalate-after.
+func applyState(state *State, health []Health, now time.Time) {
+	services := make(map[string]ServiceState, len(health))
+
+	for i := range health {
+		h := &health[i]
+
+		current := ServiceState{Status: h.Status, Since: now, Runs: 1}
+		if prev, ok := state.Services[h.ServiceGroup]; ok {
+			current.Transitions = prev.Transitions
+			if prev.Status == h.Status {
+				current.Since = prev.Since
+				current.Runs = prev.Runs + 1
+			} else {
+				current.Transitions = append(current.Transitions, now)
+			}
+		}
+		current.Transitions = recentTransitions(current.Transitions, now)
+		services[h.ServiceGroup] = current
+
+		if plugin.FlapThreshold > 0 && len(current.Transitions) > plugin.FlapThreshold {
+			h.Reason = fmt.Sprintf("flapping, %d status changes in %s", len(current.Transitions), flapWindow)
+			if plugin.FlapHold {
+				h.Status = sensu.CheckStateWarning
+				continue
+			}
+		}
+
+		if escalateAfter > 0 && h.Status == sensu.CheckStateWarning {
+			if d := now.Sub(current.Since); d >= escalateAfter {
+				h.Status = sensu.CheckStateCritical
+				h.Reason = fmt.Sprintf("WARNING for %s", d.Round(time.Second))
+			}
+		}
+	}
+
+	state.Services = services
+}
+
+// recentTransitions drops transitions that fall outside --flap-window.
+func recentTransitions(transitions []time.Time, now time.Time) []time.Time {
+	if plugin.FlapThreshold == 0 {
+		return nil
+	}
+
+	var result []time.Time
+	for _, t := range transitions {
+		if now.Sub(t) <= flapWindow {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// checkSupervisorRestart records the running supervisor in the state and
+// warns once when it differs from the one seen on the previous run.
+func checkSupervisorRestart(state *State) []Finding {
+	instance, err := supervisorInstance()
+	if err != nil {
+		return []Finding{{ServiceGroup: "hab-sup", Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+
+	previous := state.Supervisor
+	state.Supervisor = instance
+
+	if previous == "" || previous == instance {
+		return nil
+	}
+
+	return []Finding{{
+		ServiceGroup: "hab-sup",
+		Status:       sensu.CheckStateWarning,
+		Message:      fmt.Sprintf("supervisor restarted since the last run (pid:start %s, was %s)", instance, previous),
+	}}
+}
+
+// unloadedServices returns the service groups known from the previous run
+// that are no longer loaded, sorted.
+func unloadedServices(state *State, health []Health) []string {
+	current := make(map[string]bool, len(health))
+	for _, h := range health {
+		current[h.ServiceGroup] = true
+	}
+
+	var unloaded []string
+	for group := range state.Services {
+		if !current[group] {
+			unloaded = append(unloaded, group)
+		}
+	}
+	sort.Strings(unloaded)
+
+	return unloaded
+}
+
+// trackElections records since when the census has shown each service group's
+// elections unfinished, and reports those unfinished for longer than
+// --election-grace. A leader failover settles well within the grace, a wedged
+// election does not.
+func trackElections(state *State, census *CensusResponse, now time.Time) []Finding {
+	var result []Finding
+	elections := map[string]time.Time{}
+
+	for _, name := range sortedGroupNames(census) {
+		group := census.CensusGroups[name]
+		for _, e := range []struct{ kind, status string }{
+			{"election", group.ElectionStatus},
+			{"update election", group.UpdateElectionStatus},
+		} {
+			if electionSettled(e.status) {
+				continue
+			}
+
+			key := name + "/" + e.kind
+			since, ok := state.Elections[key]
+			if !ok {
+				since = now
+			}
+			elections[key] = since
+
+			if d := now.Sub(since); d >= electionGrace {
+				result = append(result, Finding{
+					ServiceGroup: name,
+					Status:       sensu.CheckStateCritical,
+					Message:      fmt.Sprintf("%s stuck in %s for %s", e.kind, e.status, d.Round(time.Second)),
+				})
+			}
+		}
+	}
+
+	state.Elections = elections
+	return result
+}
+
+func electionSettled(status string) bool {
+	return status == "" || status == "None" || status == "ElectionFinished"
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-go/types"
+)
+
+// runHealth, runFindings and runSupervisor keep the results of the last run
+// for the JSON summary, they stay empty when the run ended before services
+// were checked.
+var (
+	runHealth     []Health
+	runFindings   []Finding
+	runSupervisor *SysInfo
+)
+
+// RunSummary is the single line written to stderr with --summary-json for
+// log collection, independent of the check output.
+type RunSummary struct {
+	Timestamp     time.Time         `json:"timestamp"`
+	SupervisorURL string            `json:"supervisor_url"`
+	Supervisor    *SysInfo          `json:"supervisor,omitempty"`
+	Mode          string            `json:"mode"`
+	Status        string            `json:"status"`
+	ExitStatus    int               `json:"exit_status"`
+	DurationMS    int64             `json:"duration_ms"`
+	Services      int               `json:"services"`
+	OK            int               `json:"ok"`
+	Warning       int               `json:"warning"`
+	Critical      int               `json:"critical"`
+	Unknown       int               `json:"unknown"`
+	Findings      int               `json:"findings"`
+	Error         string            `json:"error,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+// runCheck wraps executeCheck to time the run, keep a copy of its output with
+// --output-file and write the JSON summary.
+func runCheck(event *types.Event) (int, error) {
+	start := time.Now()
+
+	var captured bytes.Buffer
+	restore := func() {}
+	if plugin.OutputFile != "" {
+		var err error
+		if restore, err = captureStdout(&captured); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("failed to capture output for --output-file: %v", err)
+		}
+	}
+
+	status, err := executeCheck(event)
+
+	if plugin.OutputFile != "" {
+		restore()
+		// the error is printed by the plugin framework once we return
+		if err != nil {
+			fmt.Fprintf(&captured, "\n%v", err)
+		}
+		if err := writeOutputFile(plugin.OutputFile, captured.Bytes(), status, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write --output-file %s: %v\n", plugin.OutputFile, err)
+		}
+	}
+
+	if plugin.SummaryJSON {
+		writeSummary(buildSummary(status, err, time.Since(start)))
+	}
+
+	return status, err
+}
+
+func buildSummary(status int, err error, duration time.Duration) RunSummary {
+	s := RunSummary{
+		Labels:        extraLabels,
+		Timestamp:     time.Now().UTC(),
+		SupervisorURL: getSupervisorUrl(),
+		Supervisor:    runSupervisor,
+		Mode:          plugin.Mode,
+		Status:        statusName(status),
+		ExitStatus:    status,
+		DurationMS:    duration.Milliseconds(),
+		Services:      len(runHealth),
+		Findings:      len(runFindings),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	for _, h := range runHealth {
+		switch h.Status {
+		case sensu.CheckStateOK:
+			s.OK++
+		case sensu.CheckStateWarning:
+			s.Warning++
+		case sensu.CheckStateCritical:
+			s.Critical++
+		default:
+			s.Unknown++
+		}
+	}
+
+	return s
+}
+
+func writeSummary(s RunSummary) {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+}
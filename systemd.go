@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+)
+
+// unitState queries systemctl for the ActiveState and SubState of unit.
+func unitState(unit string) (string, string, error) {
+	output, err := exec.Command("systemctl", "show", "--property=ActiveState,SubState", unit).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("systemctl show %s failed: %v", unit, err)
+	}
+
+	var active, sub string
+	for _, line := range strings.Split(string(output), "\n") {
+		if v := strings.TrimPrefix(line, "ActiveState="); v != line {
+			active = strings.TrimSpace(v)
+		} else if v := strings.TrimPrefix(line, "SubState="); v != line {
+			sub = strings.TrimSpace(v)
+		}
+	}
+
+	return active, sub, nil
+}
+
+// checkSystemdUnit flags a --systemd-unit that is not active while the
+// gateway answers, which points at a stale supervisor outside systemd's view.
+func checkSystemdUnit() []Finding {
+	active, sub, err := unitState(plugin.SystemdUnit)
+	if err != nil {
+		return []Finding{{ServiceGroup: plugin.SystemdUnit, Status: sensu.CheckStateWarning, Message: err.Error()}}
+	}
+
+	if active == "active" {
+		return nil
+	}
+
+	return []Finding{{
+		ServiceGroup: plugin.SystemdUnit,
+		Status:       sensu.CheckStateCritical,
+		Message:      fmt.Sprintf("unit is %s (%s) but the gateway is answering, possibly from a stale process", active, sub),
+	}}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"time"
+)
+
+// requestTrace collects the phase timings of a single request for --trace.
+type requestTrace struct {
+	start     time.Time
+	dnsStart  time.Time
+	dns       time.Duration
+	connStart time.Time
+	connect   time.Duration
+	tlsStart  time.Time
+	tls       time.Duration
+	ttfb      time.Duration
+	reused    bool
+}
+
+// withTrace attaches a client trace to req, the returned function prints the
+// timings to stderr once the request is done.
+func withTrace(req *http.Request) (*http.Request, func(err error)) {
+	t := &requestTrace{start: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		GotConn:  func(info httptrace.GotConnInfo) { t.reused = info.Reused },
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.dns = time.Since(t.dnsStart) },
+		ConnectStart: func(string, string) {
+			t.connStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.connect = time.Since(t.connStart)
+		},
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.tls = time.Since(t.tlsStart)
+		},
+		GotFirstResponseByte: func() { t.ttfb = time.Since(t.start) },
+	}
+
+	done := func(err error) {
+		total := time.Since(t.start)
+		line := fmt.Sprintf("trace %s %s: dns=%s connect=%s tls=%s ttfb=%s total=%s reused=%t",
+			req.Method, req.URL, ms(t.dns), ms(t.connect), ms(t.tls), ms(t.ttfb), ms(total), t.reused)
+		if err != nil {
+			line += fmt.Sprintf(" error=%q", err.Error())
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), done
+}
+
+func ms(d time.Duration) string {
+	return d.Round(time.Millisecond / 10).String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// maxZabbixResponse caps the length a server may announce for its response,
+// a real one answers with a line of JSON.
+const maxZabbixResponse = 1 << 20
+
+type zabbixRequest struct {
+	Request string       `json:"request"`
+	Data    []zabbixItem `json:"data"`
+}
+
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// sendZabbix pushes the health of each service to trapper items keyed
+// habitat.health[service_group], along with the overall result in
+// habitat.status, the same way zabbix_sender does.
+func sendZabbix(health []Health, status int) error {
+	host := plugin.ZabbixHost
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	req := zabbixRequest{Request: "sender data"}
+	for _, h := range health {
+		req.Data = append(req.Data, zabbixItem{
+			Host:  host,
+			Key:   "habitat.health[" + h.ServiceGroup + "]",
+			Value: strconv.Itoa(h.Status),
+		})
+	}
+	req.Data = append(req.Data, zabbixItem{Host: host, Key: "habitat.status", Value: strconv.Itoa(status)})
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	addr := plugin.ZabbixServer
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "10051")
+	}
+
+	timeout := time.Duration(plugin.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(zabbixPacket(payload)); err != nil {
+		return err
+	}
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if !bytes.Equal(header[:5], []byte("ZBXD\x01")) {
+		return fmt.Errorf("unexpected response header %q", header[:5])
+	}
+
+	length := binary.LittleEndian.Uint64(header[5:])
+	if length > maxZabbixResponse {
+		return fmt.Errorf("response of %d bytes exceeds the limit of %d bytes", length, maxZabbixResponse)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	var resp zabbixResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("server responded %q: %s", resp.Response, resp.Info)
+	}
+
+	return nil
+}
+
+// zabbixPacket frames a payload with the Zabbix protocol header and little
+// endian data length.
+func zabbixPacket(payload []byte) []byte {
+	packet := make([]byte, 13, 13+len(payload))
+	copy(packet, "ZBXD\x01")
+	binary.LittleEndian.PutUint64(packet[5:], uint64(len(payload)))
+	return append(packet, payload...)
+}